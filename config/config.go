@@ -0,0 +1,466 @@
+// Package config loads the API's settings. Each setting comes from, in
+// order of precedence: a command-line flag, an env var, the config file,
+// and finally a built-in default.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/domino14/cool-api/push"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every setting. The yaml and toml tags are the keys in the
+// config file, e.g.
+//
+//	db:
+//	  host: localhost
+//	push:
+//	  backend: webhook
+type Config struct {
+	DB        DB        `yaml:"db" toml:"db"`
+	HTTP      HTTP      `yaml:"http" toml:"http"`
+	Push      Push      `yaml:"push" toml:"push"`
+	Feed      Feed      `yaml:"feed" toml:"feed"`
+	Auth      Auth      `yaml:"auth" toml:"auth"`
+	RateLimit RateLimit `yaml:"rate_limit" toml:"rate_limit"`
+	Log       Log       `yaml:"log" toml:"log"`
+	Fixtures  Fixtures  `yaml:"fixtures" toml:"fixtures"`
+}
+
+type DB struct {
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	Name     string `yaml:"name" toml:"name"`
+	SSLMode  string `yaml:"sslmode" toml:"sslmode"`
+}
+
+type HTTP struct {
+	Port            int           `yaml:"port" toml:"port"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// IdempotencyTTL is how long idempotency keys are kept.
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl" toml:"idempotency_ttl"`
+}
+
+type Push struct {
+	Backend     string        `yaml:"backend" toml:"backend"`
+	Endpoint    string        `yaml:"endpoint" toml:"endpoint"`
+	AuthToken   string        `yaml:"auth_token" toml:"auth_token"`
+	Timeout     time.Duration `yaml:"timeout" toml:"timeout"`
+	Workers     int           `yaml:"workers" toml:"workers"`
+	MaxAttempts int           `yaml:"max_attempts" toml:"max_attempts"`
+}
+
+type Feed struct {
+	// FanoutOnReadThreshold is the follower count above which activities
+	// are merged into feeds when read. 0 means never.
+	FanoutOnReadThreshold int `yaml:"fanout_on_read_threshold" toml:"fanout_on_read_threshold"`
+	DefaultLimit          int `yaml:"default_limit" toml:"default_limit"`
+	MaxLimit              int `yaml:"max_limit" toml:"max_limit"`
+}
+
+type Auth struct {
+	// Enabled requires an API key on every request except the health and
+	// metrics endpoints.
+	Enabled bool `yaml:"enabled" toml:"enabled"`
+}
+
+// RateLimit limits how fast activities may be posted. The limits are per
+// minute, and 0 means no limit.
+type RateLimit struct {
+	// Backend keeps track of the limits: memory, or postgres to share
+	// them between instances.
+	Backend string `yaml:"backend" toml:"backend"`
+	// IP limits all the activities posted from each address.
+	IP int `yaml:"ip" toml:"ip"`
+	// TrustedProxies is a comma-separated list of the addresses or CIDR
+	// ranges of the proxies in front of the API. Requests through them are
+	// limited by the client address in X-Forwarded-For.
+	TrustedProxies string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	// The rest limit each actor's activities of that action.
+	Follow   int `yaml:"follow" toml:"follow"`
+	Unfollow int `yaml:"unfollow" toml:"unfollow"`
+	Love     int `yaml:"love" toml:"love"`
+	Unlove   int `yaml:"unlove" toml:"unlove"`
+	Read     int `yaml:"read" toml:"read"`
+	Write    int `yaml:"write" toml:"write"`
+	Comment  int `yaml:"comment" toml:"comment"`
+}
+
+// Proxies parses TrustedProxies. A bare address is a range of one.
+func (r RateLimit) Proxies() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(r.TrustedProxies, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q", p)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			p = fmt.Sprintf("%s/%d", p, bits)
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+type Log struct {
+	// Level is the least severe level logged: debug, info, warn or error.
+	Level string `yaml:"level" toml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format" toml:"format"`
+}
+
+type Fixtures struct {
+	Dir string `yaml:"dir" toml:"dir"`
+}
+
+// Default returns the built-in defaults.
+func Default() *Config {
+	return &Config{
+		DB: DB{
+			User:    "postgres",
+			Host:    "localhost",
+			Port:    5432,
+			Name:    "hooked",
+			SSLMode: "disable",
+		},
+		HTTP: HTTP{
+			Port:            8086,
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 30 * time.Second,
+			IdempotencyTTL:  24 * time.Hour,
+		},
+		Push: Push{
+			Backend:     "stdout",
+			Timeout:     push.DefaultTimeout,
+			Workers:     4,
+			MaxAttempts: 8,
+		},
+		Feed: Feed{
+			DefaultLimit: 50,
+			MaxLimit:     200,
+		},
+		Auth: Auth{Enabled: true},
+		RateLimit: RateLimit{
+			Backend:  "memory",
+			IP:       300,
+			Follow:   20,
+			Unfollow: 20,
+			Love:     60,
+			Unlove:   60,
+			Read:     120,
+			Write:    30,
+			Comment:  30,
+		},
+		Log:      Log{Level: "debug", Format: "text"},
+		Fixtures: Fixtures{Dir: "fixtures"},
+	}
+}
+
+// A setting is one Config field, with the names it goes by.
+type setting struct {
+	key    string // the flag, and the key in the file, e.g. "db.user"
+	env    string
+	usage  string
+	secret bool
+	ptr    interface{} // *string, *int, *bool or *time.Duration
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"db.user", "DB_USER", "database user", false, &c.DB.User},
+		{"db.password", "DB_PASS", "database password", true, &c.DB.Password},
+		{"db.host", "DB_HOST", "database host", false, &c.DB.Host},
+		{"db.port", "DB_PORT", "database port", false, &c.DB.Port},
+		{"db.name", "DB_NAME", "database name", false, &c.DB.Name},
+		{"db.sslmode", "DB_SSLMODE", "Postgres sslmode", false, &c.DB.SSLMode},
+		{"http.port", "PORT", "port to serve the API on", false, &c.HTTP.Port},
+		{"http.read_timeout", "HTTP_READ_TIMEOUT",
+			"HTTP read timeout", false, &c.HTTP.ReadTimeout},
+		{"http.write_timeout", "HTTP_WRITE_TIMEOUT",
+			"HTTP write timeout", false, &c.HTTP.WriteTimeout},
+		{"http.idle_timeout", "HTTP_IDLE_TIMEOUT",
+			"HTTP keep-alive idle timeout", false, &c.HTTP.IdleTimeout},
+		{"http.shutdown_timeout", "HTTP_SHUTDOWN_TIMEOUT",
+			"how long shutdown waits for requests and push deliveries", false,
+			&c.HTTP.ShutdownTimeout},
+		{"http.idempotency_ttl", "IDEMPOTENCY_TTL",
+			"how long idempotency keys are kept", false,
+			&c.HTTP.IdempotencyTTL},
+		{"push.backend", "PUSH_BACKEND", "push backend: " +
+			strings.Join(push.Backends(), ", "), false, &c.Push.Backend},
+		{"push.endpoint", "PUSH_ENDPOINT",
+			"URL of the webhook or provider push backend", false,
+			&c.Push.Endpoint},
+		{"push.auth_token", "PUSH_AUTH_TOKEN",
+			"bearer token for the push backend", true, &c.Push.AuthToken},
+		{"push.timeout", "PUSH_TIMEOUT", "timeout for each push delivery",
+			false, &c.Push.Timeout},
+		{"push.workers", "PUSH_WORKERS", "number of push delivery workers",
+			false, &c.Push.Workers},
+		{"push.max_attempts", "PUSH_MAX_ATTEMPTS",
+			"delivery attempts before a push is marked dead", false,
+			&c.Push.MaxAttempts},
+		{"feed.fanout_on_read_threshold", "FANOUT_ON_READ_THRESHOLD",
+			"follower count above which activities fan out on read (0 for never)",
+			false, &c.Feed.FanoutOnReadThreshold},
+		{"feed.default_limit", "FEED_DEFAULT_LIMIT",
+			"notifications per page when no limit is given", false,
+			&c.Feed.DefaultLimit},
+		{"feed.max_limit", "FEED_MAX_LIMIT",
+			"largest limit a client may ask for", false, &c.Feed.MaxLimit},
+		{"auth.enabled", "AUTH_ENABLED", "require API keys", false,
+			&c.Auth.Enabled},
+		{"rate_limit.backend", "RATE_LIMIT_BACKEND", "where rate limits are " +
+			"kept: memory, or postgres to share them", false,
+			&c.RateLimit.Backend},
+		{"rate_limit.ip", "RATE_LIMIT_IP", "activities a minute from each IP " +
+			"address (0 for no limit)", false, &c.RateLimit.IP},
+		{"rate_limit.trusted_proxies", "RATE_LIMIT_TRUSTED_PROXIES",
+			"comma-separated addresses or CIDR ranges of proxies whose " +
+				"X-Forwarded-For is trusted", false,
+			&c.RateLimit.TrustedProxies},
+		{"rate_limit.follow", "RATE_LIMIT_FOLLOW", "follows a minute by each " +
+			"actor (0 for no limit)", false, &c.RateLimit.Follow},
+		{"rate_limit.unfollow", "RATE_LIMIT_UNFOLLOW", "unfollows a minute by " +
+			"each actor (0 for no limit)", false, &c.RateLimit.Unfollow},
+		{"rate_limit.love", "RATE_LIMIT_LOVE", "loves a minute by each actor " +
+			"(0 for no limit)", false, &c.RateLimit.Love},
+		{"rate_limit.unlove", "RATE_LIMIT_UNLOVE", "unloves a minute by each " +
+			"actor (0 for no limit)", false, &c.RateLimit.Unlove},
+		{"rate_limit.read", "RATE_LIMIT_READ", "reads a minute by each actor " +
+			"(0 for no limit)", false, &c.RateLimit.Read},
+		{"rate_limit.write", "RATE_LIMIT_WRITE", "writes a minute by each " +
+			"actor (0 for no limit)", false, &c.RateLimit.Write},
+		{"rate_limit.comment", "RATE_LIMIT_COMMENT", "comments a minute by " +
+			"each actor (0 for no limit)", false, &c.RateLimit.Comment},
+		{"log.level", "LOG_LEVEL", "least severe level logged: debug, info, " +
+			"warn or error", false, &c.Log.Level},
+		{"log.format", "LOG_FORMAT", "log format: text or json", false,
+			&c.Log.Format},
+		{"fixtures.dir", "FIXTURES_DIR", "directory the seed command reads " +
+			"fixtures from", false, &c.Fixtures.Dir},
+	}
+}
+
+func (s setting) set(v string) error {
+	var err error
+	switch p := s.ptr.(type) {
+	case *string:
+		*p = v
+	case *int:
+		*p, err = strconv.Atoi(v)
+	case *bool:
+		*p, err = strconv.ParseBool(v)
+	case *time.Duration:
+		*p, err = time.ParseDuration(v)
+	}
+	return err
+}
+
+func (s setting) String() string {
+	switch p := s.ptr.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *time.Duration:
+		return p.String()
+	}
+	return ""
+}
+
+// Load builds the config from the defaults, the config file, env vars and
+// args, and validates it. The config file is the one named by the -config
+// flag or CONFIG_FILE, if any; it may be YAML or TOML. Load returns the
+// args left after the flags.
+func Load(name string, args []string) (*Config, []string, error) {
+	c := Default()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"),
+		"YAML or TOML config file; env CONFIG_FILE")
+	// Flags are applied last, so just note them for now.
+	flags := map[string]string{}
+	for _, s := range settings {
+		key := s.key
+		fs.Func(key, s.usage+"; env "+s.env, func(v string) error {
+			flags[key] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *file != "" {
+		if err := c.readFile(*file); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(v); err != nil {
+				return nil, nil, fmt.Errorf("bad %s: %v", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flags[s.key]; ok {
+			if err := s.set(v); err != nil {
+				return nil, nil, fmt.Errorf("bad -%s: %v", s.key, err)
+			}
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+func (c *Config) readFile(path string) error {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(dat, c)
+	case ".toml":
+		err = toml.Unmarshal(dat, c)
+	default:
+		return fmt.Errorf("%s: config files must be .yaml, .yml or .toml",
+			path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// ValidationErrors lists everything wrong with a config.
+type ValidationErrors []string
+
+func (errs ValidationErrors) Error() string {
+	return "bad config:\n  " + strings.Join(errs, "\n  ")
+}
+
+// Validate checks that the settings make sense together.
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	bad := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+	for _, s := range c.settings() {
+		switch p := s.ptr.(type) {
+		case *int:
+			if *p < 0 {
+				bad("%s must not be negative", s.key)
+			}
+		case *time.Duration:
+			if *p <= 0 {
+				bad("%s must be positive", s.key)
+			}
+		}
+	}
+	for key, v := range map[string]string{"db.user": c.DB.User,
+		"db.host": c.DB.Host, "db.name": c.DB.Name} {
+		if v == "" {
+			bad("%s is required", key)
+		}
+	}
+	if c.DB.Port < 1 || c.DB.Port > 65535 {
+		bad("db.port must be between 1 and 65535")
+	}
+	if c.HTTP.Port < 1 || c.HTTP.Port > 65535 {
+		bad("http.port must be between 1 and 65535")
+	}
+	known := false
+	for _, b := range push.Backends() {
+		known = known || b == c.Push.Backend
+	}
+	if !known {
+		bad("push.backend must be one of %s",
+			strings.Join(push.Backends(), ", "))
+	}
+	if c.Push.Backend != "stdout" && c.Push.Endpoint == "" {
+		bad("push.endpoint is required for the %s backend", c.Push.Backend)
+	}
+	if c.Push.Workers < 1 {
+		bad("push.workers must be at least 1")
+	}
+	if c.Push.MaxAttempts < 1 {
+		bad("push.max_attempts must be at least 1")
+	}
+	if c.Feed.DefaultLimit < 1 || c.Feed.DefaultLimit > c.Feed.MaxLimit {
+		bad("feed.default_limit must be between 1 and feed.max_limit")
+	}
+	switch c.RateLimit.Backend {
+	case "memory", "postgres":
+	default:
+		bad("rate_limit.backend must be memory or postgres")
+	}
+	if _, err := c.RateLimit.Proxies(); err != nil {
+		bad("rate_limit.trusted_proxies: %v", err)
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		bad("log.level must be debug, info, warn or error")
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		bad("log.format must be text or json")
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errs
+	}
+	return nil
+}
+
+// Print writes the effective config, one setting per line, with secrets
+// redacted.
+func (c *Config) Print(w io.Writer) {
+	for _, s := range c.settings() {
+		v := s.String()
+		if s.secret && v != "" {
+			v = "<redacted>"
+		}
+		fmt.Fprintf(w, "%-30s %s\n", s.key, v)
+	}
+}
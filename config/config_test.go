@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	// Start from an empty environment, as far as settings go.
+	for _, s := range Default().settings() {
+		t.Setenv(s.env, "")
+	}
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"hooked.yaml": "db:\n  host: yaml-host\n  name: yaml-name\n" +
+			"http:\n  port: 9000\n",
+		"hooked.toml": "[db]\nhost = \"toml-host\"\nname = \"toml-name\"\n" +
+			"[http]\nport = 9000\n",
+	} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CONFIG_FILE", file)
+		t.Setenv("DB_NAME", "env-name")
+		t.Setenv("PORT", "9001")
+		c, args, err := Load("hooked", []string{"-http.port", "9002",
+			"-push.timeout", "3s", "seed"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		prefix := strings.TrimPrefix(filepath.Ext(name), ".")
+		for _, got := range []struct {
+			what      string
+			got, want interface{}
+		}{
+			{"db.host from the file", c.DB.Host, prefix + "-host"},
+			{"db.name from env over the file", c.DB.Name, "env-name"},
+			{"http.port from the flag over env", c.HTTP.Port, 9002},
+			{"push.timeout from the flag", c.Push.Timeout, 3 * time.Second},
+			{"db.user by default", c.DB.User, "postgres"},
+		} {
+			if got.got != got.want {
+				t.Errorf("%s: %s = %v, want %v", name, got.what, got.got,
+					got.want)
+			}
+		}
+		if len(args) != 1 || args[0] != "seed" {
+			t.Errorf("%s: args left %v, want [seed]", name, args)
+		}
+	}
+
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("PORT", "eighty")
+	if _, _, err := Load("hooked", nil); err == nil ||
+		!strings.Contains(err.Error(), "PORT") {
+		t.Errorf("a bad PORT gave %v, want an error about it", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("the defaults aren't valid: %v", err)
+	}
+	c := Default()
+	c.DB.Host = ""
+	c.HTTP.Port = 70000
+	c.Push.Backend = "webhook"
+	c.Feed.DefaultLimit = c.Feed.MaxLimit + 1
+	c.HTTP.ReadTimeout = 0
+	c.Log.Level = "loud"
+	err := c.Validate()
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("got %v, want ValidationErrors", err)
+	}
+	want := []string{
+		"db.host is required",
+		"feed.default_limit must be between 1 and feed.max_limit",
+		"http.port must be between 1 and 65535",
+		"http.read_timeout must be positive",
+		"log.level must be debug, info, warn or error",
+		"push.endpoint is required for the webhook backend",
+	}
+	if strings.Join(errs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%v\nwant\n%v", strings.Join(errs, "\n"),
+			strings.Join(want, "\n"))
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	c := Default()
+	c.DB.Password = "hunter2"
+	var b bytes.Buffer
+	c.Print(&b)
+	out := b.String()
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("the password was printed:\n%s", out)
+	}
+	for _, line := range []string{"db.password", "<redacted>", "db.user",
+		"postgres"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("%q is missing from\n%s", line, out)
+		}
+	}
+	// The push auth token isn't set, so there's nothing to redact.
+	if strings.Count(out, "<redacted>") != 1 {
+		t.Errorf("an empty secret was redacted:\n%s", out)
+	}
+}
@@ -1,95 +1,274 @@
 package hooked
 
 import (
-	"database/sql"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"strconv"
 
+	"github.com/domino14/cool-api/logging"
+	"github.com/domino14/cool-api/push"
 	"github.com/gorilla/mux"
 )
 
-// Note: We eventually want to make this part of the context instead of a
-// global variable, but this is OK for demonstration purposes...
-var db *sql.DB
-
 const (
 	Success         = `{"msg": "OK"}`
 	JSONContentType = "application/json; charset=UTF-8"
 )
 
-func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getNotificationsHandler(w http.ResponseWriter,
+	r *http.Request) {
+
+	logger := logging.FromContext(r.Context())
 	vars := mux.Vars(r)
-	log.Printf("[DEBUG] Getting notifications for user %s", vars["id"])
-	user, err := getUser(db, vars["id"])
+	logger.Debug("Getting notifications", "user", vars["id"])
+	user, err := s.store.GetUser(r.Context(), vars["id"])
+	if err != nil {
+		sendErr(w, r, "get-user", err)
+		return
+	}
+	q, err := parseNotificationQuery(r.URL.Query(), s.defaultLimit,
+		s.maxLimit)
 	if err != nil {
-		log.Printf("[ERROR] event=get-user err=%q", err)
-		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+		sendError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
 		return
 	}
-	notifications, err := getNotifications(db, user)
+	window, err := parseGroupWindow(r.URL.Query())
 	if err != nil {
-		log.Printf("[ERROR] event=get-notifications err=%q", err)
-		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		sendError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
 		return
 	}
-	ret, err := json.MarshalIndent(notifications, "", "\t")
+	page, err := s.store.GetNotifications(r.Context(), user, q)
+	if err != nil {
+		sendErr(w, r, "get-notifications", err)
+		return
+	}
+	var ret []byte
+	if window > 0 {
+		ret, err = json.MarshalIndent(&GroupedNotificationPage{
+			Groups:     groupNotifications(page.Notifications, window),
+			NextCursor: page.NextCursor,
+		}, "", "\t")
+	} else {
+		ret, err = json.MarshalIndent(page, "", "\t")
+	}
 	if err != nil {
-		log.Printf("[ERROR] event=marshal-notifications err=%q", err)
-		http.Error(w, "Error: "+err.Error(), http.StatusInternalServerError)
+		sendErr(w, r, "marshal-notifications", err)
 		return
 	}
 	w.Header().Set("Content-Type", JSONContentType)
 	w.Write(ret)
 }
 
+func (s *Server) getUnreadCountHandler(w http.ResponseWriter,
+	r *http.Request) {
+
+	vars := mux.Vars(r)
+	user, err := s.store.GetUser(r.Context(), vars["id"])
+	if err != nil {
+		sendErr(w, r, "get-user", err)
+		return
+	}
+	n, err := s.store.CountUnread(r.Context(), user)
+	if err != nil {
+		sendErr(w, r, "count-unread", err)
+		return
+	}
+	w.Header().Set("Content-Type", JSONContentType)
+	fmt.Fprintf(w, `{"unread": %d}`, n)
+}
+
+func (s *Server) markReadHandler(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	vars := mux.Vars(r)
+	user, err := s.store.GetUser(r.Context(), vars["id"])
+	if err != nil {
+		sendErr(w, r, "get-user", err)
+		return
+	}
+	var req MarkReadRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Info("json-decode", "err", err)
+		sendError(w, http.StatusBadRequest, CodeInvalidJSON, "Bad JSON body")
+		return
+	}
+	var n int
+	switch {
+	case len(req.IDs) > 0 && req.UpTo != "":
+		err = &ValidationError{[]FieldError{{"ids",
+			"Pass either ids or up_to, not both."}}}
+	case len(req.IDs) > 0:
+		n, err = s.store.MarkRead(r.Context(), user, req.IDs)
+	case req.UpTo != "":
+		c, cerr := ParseCursor(req.UpTo)
+		if cerr != nil {
+			err = &ValidationError{[]FieldError{{"up_to", cerr.Error()}}}
+			break
+		}
+		n, err = s.store.MarkReadUpTo(r.Context(), user, *c)
+	default:
+		err = &ValidationError{[]FieldError{{"ids",
+			"Must provide ids or up_to."}}}
+	}
+	if err != nil {
+		sendErr(w, r, "mark-read", err)
+		return
+	}
+	w.Header().Set("Content-Type", JSONContentType)
+	fmt.Fprintf(w, `{"marked": %d}`, n)
+}
+
 func sendSuccess(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", JSONContentType)
 	fmt.Fprint(w, Success)
 }
 
-func postActivityHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
+func (s *Server) postActivityHandler(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	// Keep the body, to fingerprint it for the idempotency key.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Info("read-body", "err", err)
+		sendError(w, http.StatusBadRequest, CodeBadRequest,
+			"Couldn't read the body.")
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
 	var a Activity
-	err := decoder.Decode(&a)
+	err = decoder.Decode(&a)
 	if err != nil {
-		log.Printf("[ERROR] event=json-decode err=%q", err)
-		http.Error(w, "Bad JSON body", http.StatusBadRequest)
+		logger.Info("json-decode", "err", err)
+		sendError(w, http.StatusBadRequest, CodeInvalidJSON, "Bad JSON body")
+		return
+	}
+	if k, ok := APIKeyFromContext(r.Context()); ok && a.Actor == "" {
+		// The actor defaults to whoever is posting.
+		a.Actor = k.UserID
+	}
+	if !s.allowed(r, a.Actor) {
+		sendError(w, http.StatusForbidden, CodeForbidden,
+			"You may only post activities as yourself.")
 		return
 	}
-	err = a.Validate(db)
+	req, ok := s.idempotentRequest(w, r, body)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	// With an idempotency key, the key is claimed in the same transaction
+	// as the activity is saved, so that a retry either finds the activity
+	// saved along with its response, or saves it itself.
+	var prev *IdempotentRequest
+	var res []byte
+	event := ""
+	err = s.store.Atomic(ctx, func(tx Store) error {
+		if req != nil {
+			var err error
+			event = "claim-idempotency-key"
+			prev, err = tx.ClaimIdempotencyKey(ctx, req)
+			if err != nil || prev != nil {
+				return err
+			}
+		}
+		event = "validate-activity"
+		if err := a.Validate(ctx, tx); err != nil {
+			return err
+		}
+
+		logger.Debug("Got new activity", "action", a.Action, "actor", a.Actor,
+			"user2", a.User2, "story", a.Story)
+
+		event = "saving-activity"
+		if err := a.Save(ctx, tx); err != nil {
+			return err
+		}
+		// The activity's ID is what it can be deleted by.
+		res = []byte(fmt.Sprintf(`{"msg": "OK", "_id": %q}`, a.ID))
+		if req != nil {
+			event = "set-idempotent-response"
+			req.Status, req.Body = http.StatusOK, res
+			return tx.SetIdempotentResponse(ctx, req)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("[ERROR] event=validation-error err=%q", err)
-		http.Error(w, "Bad activity: "+err.Error(), http.StatusBadRequest)
+		sendErr(w, r, event, err)
+		return
+	}
+	if prev != nil {
+		replayResponse(w, r, req, prev)
 		return
 	}
+	w.Header().Set("Content-Type", JSONContentType)
+	w.Write(res)
+}
 
-	log.Printf("[DEBUG] Got new activity: %v", a)
+func (s *Server) deleteActivityHandler(w http.ResponseWriter,
+	r *http.Request) {
 
-	err = a.Save(db)
+	id := mux.Vars(r)["id"]
+	a, err := s.store.GetActivity(r.Context(), id)
 	if err != nil {
-		log.Printf("[ERROR] event=saving-activity err=%q", err)
-		http.Error(w, "Could not save activity: "+err.Error(),
-			http.StatusInternalServerError)
+		sendErr(w, r, "get-activity", err)
+		return
+	}
+	if !s.allowed(r, a.Actor) {
+		sendError(w, http.StatusForbidden, CodeForbidden,
+			"You may only delete your own activities.")
 		return
 	}
-	// Send push notifications
-	err = a.PushNotify()
+	err = s.store.DeleteActivity(r.Context(), id)
 	if err != nil {
-		log.Printf("[ERROR] event=push-notification err=%q", err)
-		http.Error(w, "Push notification error: "+err.Error(),
-			http.StatusInternalServerError)
+		sendErr(w, r, "delete-activity", err)
 		return
 	}
+	logging.FromContext(r.Context()).Info("Deleted activity", "id", id,
+		"action", a.Action)
 	sendSuccess(w)
 }
 
-func Serve(d *sql.DB, port string) {
-	db = d
-	r := mux.NewRouter()
-	r.HandleFunc("/user/{id}/notifications",
-		getNotificationsHandler).Methods("GET")
-	r.HandleFunc("/activity", postActivityHandler).Methods("POST")
-	log.Fatal(http.ListenAndServe(":8086", r))
+func (s *Server) getDeadPushesHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			sendError(w, http.StatusBadRequest, CodeBadRequest,
+				"limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+	deliveries, err := s.dispatcher.Outbox.DeadLetters(limit)
+	if err != nil {
+		sendErr(w, r, "get-dead-pushes", err)
+		return
+	}
+	ret, err := json.MarshalIndent(deliveries, "", "\t")
+	if err != nil {
+		sendErr(w, r, "marshal-dead-pushes", err)
+		return
+	}
+	w.Header().Set("Content-Type", JSONContentType)
+	w.Write(ret)
+}
+
+func (s *Server) replayPushHandler(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	vars := mux.Vars(r)
+	err := s.dispatcher.Outbox.Replay(vars["id"])
+	if err == push.ErrNotDead {
+		sendError(w, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		sendErr(w, r, "replay-push", err)
+		return
+	}
+	logger.Info("Replaying dead push notification",
+		"delivery_id", vars["id"])
+	sendSuccess(w)
 }
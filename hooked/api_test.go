@@ -0,0 +1,307 @@
+package hooked
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/domino14/cool-api/push"
+)
+
+// newTestServer returns the handler of a server on m, with auth off unless
+// opts turn it back on.
+func newTestServer(t *testing.T, m *MemoryStore, opts ...Option) http.Handler {
+	s, err := NewServer(append([]Option{WithStore(m), WithAuth(false)},
+		opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Handler()
+}
+
+// serve sends h a request with the given body and header name/value pairs,
+// and returns the response.
+func serve(h http.Handler, method, url, body string,
+	header ...string) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decode decodes the JSON body of w into v.
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+}
+
+func TestPostActivity(t *testing.T) {
+	h := newTestServer(t, newTestMemoryStore(t))
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"action":"love","actor":"u1","story":"s1"}`, http.StatusOK},
+		{`{"action":"love","actor":"u1"`, http.StatusBadRequest},
+		{`{"action":"dance","actor":"u1"}`, http.StatusUnprocessableEntity},
+		{`{"action":"love","actor":"u1","story":"nope"}`,
+			http.StatusUnprocessableEntity},
+	} {
+		w := serve(h, "POST", "/activity", tc.body)
+		if w.Code != tc.status {
+			t.Errorf("POST %s: status %d, want %d: %s", tc.body, w.Code,
+				tc.status, w.Body)
+		}
+	}
+
+	// u2 follows u1, so only u2 hears about the love.
+	var page NotificationPage
+	w := serve(h, "GET", "/user/u2/notifications", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET notifications: status %d: %s", w.Code, w.Body)
+	}
+	decode(t, w, &page)
+	if len(page.Notifications) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(page.Notifications))
+	}
+	n := page.Notifications[0]
+	if n.Action != ActionLove || n.Actor != "u1" || n.Story != "s1" {
+		t.Errorf("got %+v, want u1's love of s1", n)
+	}
+	decode(t, serve(h, "GET", "/user/u3/notifications", ""), &page)
+	if len(page.Notifications) != 0 {
+		t.Errorf("u3 got %d notifications, want none",
+			len(page.Notifications))
+	}
+	if w := serve(h, "GET", "/user/nobody/notifications", ""); w.Code !=
+		http.StatusNotFound {
+		t.Errorf("GET a missing user's notifications: status %d, want 404",
+			w.Code)
+	}
+}
+
+func TestMarkReadHandler(t *testing.T) {
+	h := newTestServer(t, newTestMemoryStore(t))
+	for i := 0; i < 2; i++ {
+		w := serve(h, "POST", "/activity",
+			`{"action":"love","actor":"u1","story":"s1"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST /activity: status %d: %s", w.Code, w.Body)
+		}
+	}
+	unread := func() int {
+		var count struct{ Unread int }
+		decode(t, serve(h, "GET", "/user/u2/notifications/unread_count", ""),
+			&count)
+		return count.Unread
+	}
+	if n := unread(); n != 2 {
+		t.Fatalf("%d unread, want 2", n)
+	}
+	var page NotificationPage
+	decode(t, serve(h, "GET", "/user/u2/notifications", ""), &page)
+	id := page.Notifications[0].ID
+
+	for _, tc := range []struct {
+		body   string
+		status int
+		marked int
+	}{
+		{`{"ids":["` + id + `"]}`, http.StatusOK, 1},
+		{`{"ids":["` + id + `"]}`, http.StatusOK, 0},
+		{`{}`, http.StatusUnprocessableEntity, 0},
+		{`{"ids":["` + id + `"],"up_to":"x"}`,
+			http.StatusUnprocessableEntity, 0},
+		{`{"up_to":"x"}`, http.StatusUnprocessableEntity, 0},
+	} {
+		w := serve(h, "POST", "/user/u2/notifications/read", tc.body)
+		if w.Code != tc.status {
+			t.Errorf("POST %s: status %d, want %d: %s", tc.body, w.Code,
+				tc.status, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var res struct{ Marked int }
+		decode(t, w, &res)
+		if res.Marked != tc.marked {
+			t.Errorf("POST %s: marked %d, want %d", tc.body, res.Marked,
+				tc.marked)
+		}
+	}
+	if n := unread(); n != 1 {
+		t.Errorf("%d unread, want 1", n)
+	}
+	decode(t, serve(h, "GET", "/user/u2/notifications", ""), &page)
+	if page.Notifications[0].ReadAt == "" {
+		t.Errorf("%s isn't read", id)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	m := newTestMemoryStore(t)
+	h := newTestServer(t, m)
+	// Saving fails, so that the error is an internal one.
+	failing := newTestServer(t, m,
+		WithStore(failingStore{m, "InsertActivity"}))
+	for _, tc := range []struct {
+		h            http.Handler
+		method, url  string
+		body         string
+		status       int
+		code, fields string
+	}{
+		{h, "POST", "/activity", `{"action":`, http.StatusBadRequest,
+			CodeInvalidJSON, ""},
+		{h, "POST", "/activity", `{"action":"dance"}`,
+			http.StatusUnprocessableEntity, CodeValidation, "action,actor"},
+		{h, "POST", "/activity", `{"action":"love","actor":"u1","story":"nope"}`,
+			http.StatusUnprocessableEntity, CodeValidation, "story"},
+		{h, "GET", "/user/nobody/notifications", "", http.StatusNotFound,
+			CodeUserNotFound, ""},
+		{h, "DELETE", "/activity/nope", "", http.StatusNotFound,
+			CodeNoActivity, ""},
+		{h, "GET", "/nowhere", "", http.StatusNotFound, CodeNotFound, ""},
+		{h, "PUT", "/activity", "", http.StatusMethodNotAllowed,
+			CodeNotAllowed, ""},
+		{failing, "POST", "/activity",
+			`{"action":"love","actor":"u1","story":"s1"}`,
+			http.StatusInternalServerError, CodeInternal, ""},
+	} {
+		w := serve(tc.h, tc.method, tc.url, tc.body)
+		if w.Code != tc.status {
+			t.Errorf("%s %s %s: status %d, want %d: %s", tc.method, tc.url,
+				tc.body, w.Code, tc.status, w.Body)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+			"application/json") {
+			t.Errorf("%s %s: Content-Type %q, want JSON", tc.method, tc.url,
+				ct)
+		}
+		var res ErrorResponse
+		decode(t, w, &res)
+		var fields []string
+		for _, f := range res.Error.Fields {
+			fields = append(fields, f.Field)
+		}
+		if res.Error.Code != tc.code || res.Error.Message == "" ||
+			strings.Join(fields, ",") != tc.fields {
+			t.Errorf("%s %s %s: got %s, want code %s and fields %q",
+				tc.method, tc.url, tc.body, w.Body, tc.code, tc.fields)
+		}
+		// Internal errors don't leak what went wrong.
+		if strings.Contains(w.Body.String(), errInjected.Error()) {
+			t.Errorf("%s %s: the error was sent to the client: %s",
+				tc.method, tc.url, w.Body)
+		}
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryStore(t)
+	userKey, _, err := NewAPIKey(ctx, m, "u1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminKey, _, err := NewAPIKey(ctx, m, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The outbox is never reached: nobody gets past auth but the admin, and
+	// their bad limit is turned away first.
+	h := newTestServer(t, m, WithAuth(true),
+		WithPush(push.NewDispatcher(push.NewOutbox(nil), nil)))
+	for _, tc := range []struct {
+		method, url string
+		key         string
+		status      int
+	}{
+		{"GET", "/admin/push/dead", "", http.StatusUnauthorized},
+		{"GET", "/admin/push/dead", "hk_nope", http.StatusUnauthorized},
+		{"GET", "/admin/push/dead", userKey, http.StatusForbidden},
+		{"POST", "/admin/push/abc/replay", "", http.StatusUnauthorized},
+		{"POST", "/admin/push/abc/replay", userKey, http.StatusForbidden},
+		{"GET", "/admin/push/dead?limit=0", adminKey, http.StatusBadRequest},
+	} {
+		var header []string
+		if tc.key != "" {
+			header = []string{"Authorization", "Bearer " + tc.key}
+		}
+		w := serve(h, tc.method, tc.url, "", header...)
+		if w.Code != tc.status {
+			t.Errorf("%s %s with key %q: status %d, want %d: %s", tc.method,
+				tc.url, tc.key, w.Code, tc.status, w.Body)
+		}
+	}
+}
+
+func TestDeleteActivityHandler(t *testing.T) {
+	// Fanned out on write, and merged in on read.
+	for _, opts := range [][]StoreOption{nil, {WithFanoutOnRead(1)}} {
+		m := newTestMemoryStore(t, opts...)
+		// With two followers, u1 is over the fan-out-on-read threshold.
+		err := m.AddFollower(context.Background(), "u1", "u3",
+			"2017-06-27T00:00:00.000Z")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := newTestServer(t, m)
+		notifications := func() int {
+			var page NotificationPage
+			decode(t, serve(h, "GET", "/user/u2/notifications", ""), &page)
+			return len(page.Notifications)
+		}
+		var ids []string
+		for _, body := range []string{
+			`{"action":"love","actor":"u1","story":"s1"}`,
+			`{"action":"write","actor":"u1"}`,
+		} {
+			w := serve(h, "POST", "/activity", body)
+			var res struct {
+				Msg string
+				ID  string `json:"_id"`
+			}
+			decode(t, w, &res)
+			if w.Code != http.StatusOK || res.Msg != "OK" || res.ID == "" {
+				t.Fatalf("POST %s: got %d %s, want OK and an _id", body,
+					w.Code, w.Body)
+			}
+			ids = append(ids, res.ID)
+		}
+		if n := notifications(); n != 2 {
+			t.Fatalf("%d notifications, want 2", n)
+		}
+
+		if w := serve(h, "DELETE", "/activity/"+ids[0], ""); w.Code !=
+			http.StatusOK {
+			t.Fatalf("DELETE %s: status %d: %s", ids[0], w.Code, w.Body)
+		}
+		var page NotificationPage
+		decode(t, serve(h, "GET", "/user/u2/notifications", ""), &page)
+		if len(page.Notifications) != 1 ||
+			page.Notifications[0].Action != ActionWrite {
+			t.Errorf("after deleting the love: got %+v, want just the write",
+				page.Notifications)
+		}
+		serve(h, "DELETE", "/activity/"+ids[1], "")
+		if n := notifications(); n != 0 {
+			t.Errorf("%d notifications after deleting both, want none", n)
+		}
+		if w := serve(h, "DELETE", "/activity/"+ids[1], ""); w.Code !=
+			http.StatusNotFound {
+			t.Errorf("DELETE %s again: status %d, want 404", ids[1], w.Code)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package hooked
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/domino14/cool-api/logging"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+)
+
+// ErrKeyNotFound is returned for API keys that don't exist, or have been
+// revoked.
+var ErrKeyNotFound = errors.New("API key not found.")
+
+// An APIKey lets a client call the API as a user, or as an admin. The key
+// itself is only known to the client; we keep its hash.
+type APIKey struct {
+	ID        string
+	Hash      string
+	UserID    string // empty for admin keys that don't belong to a user
+	Admin     bool
+	CreatedAt time.Time
+}
+
+// KeyStore keeps the API keys.
+type KeyStore interface {
+	// GetAPIKey returns the unrevoked key with the given hash.
+	GetAPIKey(ctx context.Context, hash string) (*APIKey, error)
+	AddAPIKey(ctx context.Context, k *APIKey) error
+	// RevokeAPIKey revokes the key with the given ID.
+	RevokeAPIKey(ctx context.Context, id string) error
+}
+
+// keyPrefix starts every key, so that they're easy to spot, e.g. when
+// they're accidentally committed.
+const keyPrefix = "hk_"
+
+// hashKey returns the hash that a key is stored and looked up by. Keys are
+// long and random, so a fast hash is fine.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey creates an API key for the user, or an admin key, and returns
+// the key itself. Only its hash is stored, so this is the only chance to
+// see it.
+func NewAPIKey(ctx context.Context, s Store, userID string, admin bool) (
+	string, *APIKey, error) {
+
+	if userID == "" && !admin {
+		return "", nil, errors.New("A non-admin key needs a user.")
+	}
+	if userID != "" {
+		if _, err := s.GetUser(ctx, userID); err != nil {
+			return "", nil, err
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	key := keyPrefix + hex.EncodeToString(b)
+	k := &APIKey{
+		ID:        uuid.NewV4().String(),
+		Hash:      hashKey(key),
+		UserID:    userID,
+		Admin:     admin,
+		CreatedAt: time.Now(),
+	}
+	if err := s.AddAPIKey(ctx, k); err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+type apiKeyCtxKey struct{}
+
+// APIKeyFromContext returns the key that the request was authenticated
+// with, if any.
+func APIKeyFromContext(ctx context.Context) (*APIKey, bool) {
+	k, ok := ctx.Value(apiKeyCtxKey{}).(*APIKey)
+	return k, ok
+}
+
+// authMiddleware requires a valid "Authorization: Bearer <key>" header,
+// and puts the key in the request's context.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			sendUnauthorized(w, "Missing bearer token.")
+			return
+		}
+		k, err := s.store.GetAPIKey(r.Context(),
+			hashKey(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))))
+		if err == ErrKeyNotFound {
+			sendUnauthorized(w, "Bad API key.")
+			return
+		}
+		if err != nil {
+			sendErr(w, r, "get-api-key", err)
+			return
+		}
+		ctx := context.WithValue(r.Context(), apiKeyCtxKey{}, k)
+		logger := logging.FromContext(ctx).With("key_id", k.ID)
+		if k.UserID != "" {
+			logger = logger.With("auth_user", k.UserID)
+		}
+		ctx = logging.NewContext(ctx, logger)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func sendUnauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="hooked"`)
+	sendError(w, http.StatusUnauthorized, CodeUnauthorized, msg)
+}
+
+// allowed reports whether the request may act as the user. Admins may act
+// as anyone. With auth off, everyone may.
+func (s *Server) allowed(r *http.Request, userID string) bool {
+	if !s.auth {
+		return true
+	}
+	k, ok := APIKeyFromContext(r.Context())
+	return ok && (k.Admin || k.UserID == userID)
+}
+
+// requireSelf lets a request through only if it may act as the user in
+// the URL.
+func (s *Server) requireSelf(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowed(r, mux.Vars(r)["id"]) {
+			sendError(w, http.StatusForbidden, CodeForbidden,
+				"You may only see your own notifications.")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAdmin lets a request through only if it has an admin key.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, ok := APIKeyFromContext(r.Context())
+		if s.auth && !(ok && k.Admin) {
+			sendError(w, http.StatusForbidden, CodeForbidden,
+				"This needs an admin key.")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,122 @@
+package hooked
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/domino14/cool-api/logging"
+)
+
+// ErrValidation matches any *ValidationError, with errors.Is.
+var ErrValidation = errors.New("Validation failed.")
+
+// A FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// A ValidationError lists everything wrong with a request.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return strings.Join(msgs, " ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// add records a problem with the field.
+func (e *ValidationError) add(field, msg string) {
+	e.Fields = append(e.Fields, FieldError{field, msg})
+}
+
+// err returns e if it has any problems, and nil otherwise.
+func (e *ValidationError) err() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Error codes. Every error response has one, so that clients don't have to
+// match on messages.
+const (
+	CodeBadRequest    = "bad_request"
+	CodeInvalidJSON   = "invalid_json"
+	CodeUnauthorized  = "unauthorized"
+	CodeForbidden     = "forbidden"
+	CodeValidation    = "validation_failed"
+	CodeUserNotFound  = "user_not_found"
+	CodeStoryNotFound = "story_not_found"
+	CodeNoActivity    = "activity_not_found"
+	CodeNotFound      = "not_found"
+	CodeNotAllowed    = "method_not_allowed"
+	CodeRateLimited   = "rate_limited"
+	CodeKeyReused     = "idempotency_key_reused"
+	CodeInternal      = "internal_error"
+)
+
+// APIError is the body of every error response, inside an ErrorResponse.
+type APIError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// ErrorResponse is the envelope that error responses are sent in, e.g.
+//
+//	{"error": {"code": "user_not_found", "message": "..."}}
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// sendError writes an error response.
+func sendError(w http.ResponseWriter, status int, code, msg string,
+	fields ...FieldError) {
+
+	body, _ := json.Marshal(ErrorResponse{APIError{code, msg, fields}})
+	w.Header().Set("Content-Type", JSONContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// sendErr writes the error response for err, which came from the store or
+// the models: 404 for missing users, stories and activities, 422 for
+// validation failures, and 500 for anything else. It's logged as event; at
+// error level for a 500, since then the details aren't sent to the client.
+func sendErr(w http.ResponseWriter, r *http.Request, event string,
+	err error) {
+
+	logger := logging.FromContext(r.Context())
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		logger.Debug(event, "err", err)
+		sendError(w, http.StatusUnprocessableEntity, CodeValidation,
+			ErrValidation.Error(), verr.Fields...)
+	case errors.Is(err, ErrUserNotFound):
+		logger.Debug(event, "err", err)
+		sendError(w, http.StatusNotFound, CodeUserNotFound, err.Error())
+	case errors.Is(err, ErrStoryNotFound):
+		logger.Debug(event, "err", err)
+		sendError(w, http.StatusNotFound, CodeStoryNotFound, err.Error())
+	case errors.Is(err, ErrActivityNotFound):
+		logger.Debug(event, "err", err)
+		sendError(w, http.StatusNotFound, CodeNoActivity, err.Error())
+	default:
+		logger.Error(event, "err", err)
+		sendError(w, http.StatusInternalServerError, CodeInternal,
+			"Internal server error.")
+	}
+}
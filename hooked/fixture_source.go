@@ -0,0 +1,200 @@
+package hooked
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FixtureSource says which files to load fixtures from. Each file can be
+// a JSON array (.json), newline-delimited JSON (.ndjson or .jsonl), or CSV
+// with a header row (.csv). Field names are the same in every format,
+// e.g. _id, firstname and lastname for users.
+type FixtureSource struct {
+	Users      string
+	Stories    string
+	Activities string
+}
+
+// fixtureExts are the supported extensions, in the order FixtureDir looks
+// for them.
+var fixtureExts = []string{".json", ".ndjson", ".jsonl", ".csv"}
+
+// FixtureDir finds the users, stories and activities files in dir, in any
+// of the supported formats.
+func FixtureDir(dir string) (FixtureSource, error) {
+	var src FixtureSource
+	for _, f := range []struct {
+		name string
+		path *string
+	}{{"users", &src.Users}, {"stories", &src.Stories},
+		{"activities", &src.Activities}} {
+		for _, ext := range fixtureExts {
+			path := filepath.Join(dir, f.name+ext)
+			if _, err := os.Stat(path); err == nil {
+				*f.path = path
+				break
+			}
+		}
+		if *f.path == "" {
+			return src, fmt.Errorf("no %s fixtures in %s (looked for %s.{%s})",
+				f.name, dir, f.name, strings.Join(fixtureExts, ","))
+		}
+	}
+	return src, nil
+}
+
+// A recordDecoder reads records from a fixture file one at a time.
+type recordDecoder interface {
+	// Next decodes the next record into v, which must point to a struct
+	// with json tags. It returns io.EOF after the last record.
+	Next(v interface{}) error
+}
+
+func openRecords(path string, r io.Reader) (recordDecoder, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return newJSONArrayDecoder(r)
+	case ".ndjson", ".jsonl":
+		return ndjsonDecoder{json.NewDecoder(r)}, nil
+	case ".csv":
+		return newCSVDecoder(r)
+	}
+	return nil, fmt.Errorf("unsupported fixture format %q",
+		filepath.Ext(path))
+}
+
+// readRecords calls next once per record in the file, until it returns
+// io.EOF.
+func readRecords(path string, next func(d recordDecoder) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := openRecords(path, bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for i := 0; ; i++ {
+		err := next(d)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: record %d: %v", path, i, err)
+		}
+	}
+}
+
+type jsonArrayDecoder struct {
+	dec *json.Decoder
+}
+
+func newJSONArrayDecoder(r io.Reader) (*jsonArrayDecoder, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("expected a JSON array")
+	}
+	return &jsonArrayDecoder{dec}, nil
+}
+
+func (d *jsonArrayDecoder) Next(v interface{}) error {
+	if !d.dec.More() {
+		if _, err := d.dec.Token(); err != nil { // the closing ]
+			return err
+		}
+		return io.EOF
+	}
+	return d.dec.Decode(v)
+}
+
+type ndjsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d ndjsonDecoder) Next(v interface{}) error {
+	return d.dec.Decode(v)
+}
+
+type csvDecoder struct {
+	r      *csv.Reader
+	header []string
+	kinds  map[string]reflect.Kind // of the fields, by JSON name
+}
+
+func newCSVDecoder(r io.Reader) (*csvDecoder, error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing CSV header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &csvDecoder{r: cr, header: append([]string(nil), header...)}, nil
+}
+
+// Next maps the row to a JSON object by the header, and decodes that.
+// Columns are converted to the type of the field they go in, so that e.g.
+// an activity's retract can be "true"; an empty column leaves the field
+// alone.
+func (d *csvDecoder) Next(v interface{}) error {
+	row, err := d.r.Read()
+	if err != nil {
+		return err
+	}
+	if d.kinds == nil {
+		d.kinds = fieldKinds(v)
+	}
+	obj := make(map[string]interface{}, len(row))
+	for i, col := range d.header {
+		if row[i] == "" {
+			continue
+		}
+		switch d.kinds[col] {
+		case reflect.Bool:
+			b, err := strconv.ParseBool(row[i])
+			if err != nil {
+				return fmt.Errorf("%s: %q isn't true or false", col, row[i])
+			}
+			obj[col] = b
+		default:
+			obj[col] = row[i]
+		}
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// fieldKinds returns the kinds of the fields of the struct v points to, by
+// their JSON names.
+func fieldKinds(v interface{}) map[string]reflect.Kind {
+	kinds := map[string]reflect.Kind{}
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		kinds[name] = f.Type.Kind()
+	}
+	return kinds
+}
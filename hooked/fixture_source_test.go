@@ -0,0 +1,82 @@
+package hooked
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadRecords(t *testing.T) {
+	dir := t.TempDir()
+	want := []Activity{
+		{ID: "a1", Action: ActionFollow, Date: "2017-06-27T00:00:00Z",
+			Actor: "u2", User2: "u1"},
+		{ID: "a2", Action: ActionUnfollow, Date: "2017-06-28T00:00:00Z",
+			Actor: "u2", User2: "u1", Retract: true},
+		{ID: "a3", Action: ActionLove, Date: "2017-06-29T00:00:00Z",
+			Actor: "u1", Story: "s1"},
+	}
+	for _, f := range []struct{ name, body string }{
+		{"activities.json", `[
+			{"_id": "a1", "action": "follow", "date": "2017-06-27T00:00:00Z",
+			 "actor": "u2", "user2": "u1"},
+			{"_id": "a2", "action": "unfollow", "date": "2017-06-28T00:00:00Z",
+			 "actor": "u2", "user2": "u1", "retract": true},
+			{"_id": "a3", "action": "love", "date": "2017-06-29T00:00:00Z",
+			 "actor": "u1", "story": "s1"}
+		]`},
+		{"activities.ndjson", `{"_id": "a1", "action": "follow", "date": "2017-06-27T00:00:00Z", "actor": "u2", "user2": "u1"}
+{"_id": "a2", "action": "unfollow", "date": "2017-06-28T00:00:00Z", "actor": "u2", "user2": "u1", "retract": true}
+{"_id": "a3", "action": "love", "date": "2017-06-29T00:00:00Z", "actor": "u1", "story": "s1"}
+`},
+		{"activities.csv", `_id,action,date,actor,user2,story,retract
+a1,follow,2017-06-27T00:00:00Z,u2,u1,,
+a2,unfollow,2017-06-28T00:00:00Z,u2,u1,,true
+a3,love,2017-06-29T00:00:00Z,u1,,s1,false
+`},
+	} {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var got []Activity
+		err := readRecords(path, func(d recordDecoder) error {
+			var a Activity
+			if err := d.Next(&a); err != nil {
+				return err
+			}
+			got = append(got, a)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %v", f.name, err)
+			continue
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d activities, want %d", f.name, len(got),
+				len(want))
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: record %d: got %+v, want %+v", f.name, i, got[i],
+					want[i])
+			}
+		}
+	}
+
+	path := filepath.Join(dir, "bad.csv")
+	err := ioutil.WriteFile(path,
+		[]byte("_id,action,retract\na1,unfollow,yes please\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = readRecords(path, func(d recordDecoder) error {
+		var a Activity
+		return d.Next(&a)
+	})
+	if err == nil || !strings.Contains(err.Error(), "retract") {
+		t.Errorf("a bad retract column gave %v, want an error about it", err)
+	}
+}
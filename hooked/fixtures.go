@@ -0,0 +1,223 @@
+package hooked
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A FixtureError is a problem with one fixture row.
+type FixtureError struct {
+	File  string // e.g. "users.json"
+	Index int    // of the row in the file, from 0
+	ID    string
+	Field string
+	Msg   string
+}
+
+func (e *FixtureError) Error() string {
+	s := fmt.Sprintf("%s[%d]", e.File, e.Index)
+	if e.ID != "" {
+		s += " (" + e.ID + ")"
+	}
+	if e.Field != "" {
+		s += " " + e.Field
+	}
+	return s + ": " + e.Msg
+}
+
+// FixtureErrors is every problem found in a set of fixtures.
+type FixtureErrors []*FixtureError
+
+func (errs FixtureErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d bad fixture rows:\n  %s", len(errs),
+		strings.Join(msgs, "\n  "))
+}
+
+// TableReport counts what happened to one table's fixtures.
+type TableReport struct {
+	Read     int // rows in the fixture file
+	Invalid  int // rows skipped because they failed validation
+	Inserted int
+	Updated  int
+	// The rest were already there and left alone.
+}
+
+// SeedReport summarizes a fixture load.
+type SeedReport struct {
+	Users         TableReport
+	Stories       TableReport
+	Activities    TableReport
+	Notifications int // created
+	Followers     int // follow relationships added
+	Problems      FixtureErrors
+}
+
+// Print writes a human-readable summary of the report.
+func (r *SeedReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "%-12s %8s %8s %8s %8s %10s\n", "", "read", "invalid",
+		"inserted", "updated", "unchanged")
+	for _, t := range []struct {
+		name string
+		r    TableReport
+	}{{"users", r.Users}, {"stories", r.Stories},
+		{"activities", r.Activities}} {
+		fmt.Fprintf(w, "%-12s %8d %8d %8d %8d %10d\n", t.name, t.r.Read,
+			t.r.Invalid, t.r.Inserted, t.r.Updated,
+			t.r.Read-t.r.Invalid-t.r.Inserted-t.r.Updated)
+	}
+	fmt.Fprintf(w, "%d notifications created, %d followers added\n",
+		r.Notifications, r.Followers)
+	if len(r.Problems) > 0 {
+		fmt.Fprintf(w, "Skipped %d bad rows:\n", len(r.Problems))
+		for _, p := range r.Problems {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+	}
+}
+
+// fixtureSet is the contents of the fixture files.
+type fixtureSet struct {
+	src        FixtureSource
+	users      []User
+	stories    []Story
+	activities []Activity
+}
+
+// validate checks the fixtures, including that every reference points at
+// a user or story that is either in the fixtures or in existing. It
+// returns the valid rows, and a problem for each of the others. A row
+// referring to an invalid row is invalid too.
+func (f *fixtureSet) validate(existing func(table string,
+	ids []string) (map[string]bool, error)) (*fixtureSet, FixtureErrors,
+	error) {
+
+	var problems FixtureErrors
+	valid := &fixtureSet{src: f.src}
+	usersFile := filepath.Base(f.src.Users)
+	storiesFile := filepath.Base(f.src.Stories)
+	activitiesFile := filepath.Base(f.src.Activities)
+	bad := func(file string, i int, id, field, msg string) {
+		problems = append(problems, &FixtureError{
+			File: file, Index: i, ID: id, Field: field, Msg: msg,
+		})
+	}
+
+	users := map[string]bool{}
+	for i, u := range f.users {
+		switch {
+		case u.ID == "" || len(u.ID) > 24:
+			bad(usersFile, i, u.ID, "_id", "must be 1 to 24 characters")
+		case users[u.ID]:
+			bad(usersFile, i, u.ID, "_id", "is a duplicate")
+		case u.FirstName == "" || len(u.FirstName) > 40:
+			bad(usersFile, i, u.ID, "firstname", "must be 1 to 40 characters")
+		case u.LastName == "" || len(u.LastName) > 40:
+			bad(usersFile, i, u.ID, "lastname", "must be 1 to 40 characters")
+		default:
+			users[u.ID] = true
+			valid.users = append(valid.users, u)
+		}
+	}
+	// Users that aren't in the fixtures may already be in the database.
+	var refs []string
+	for _, s := range f.stories {
+		refs = append(refs, s.Author)
+	}
+	for _, a := range f.activities {
+		refs = append(refs, a.Actor, a.User2)
+	}
+	if err := addExisting(users, "users", refs, existing); err != nil {
+		return nil, nil, err
+	}
+
+	stories := map[string]bool{}
+	for i, s := range f.stories {
+		switch {
+		case s.ID == "" || len(s.ID) > 24:
+			bad(storiesFile, i, s.ID, "_id", "must be 1 to 24 characters")
+		case stories[s.ID]:
+			bad(storiesFile, i, s.ID, "_id", "is a duplicate")
+		case s.Title == "" || len(s.Title) > 128:
+			bad(storiesFile, i, s.ID, "title", "must be 1 to 128 characters")
+		case !users[s.Author]:
+			bad(storiesFile, i, s.ID, "author",
+				fmt.Sprintf("unknown user %q", s.Author))
+		default:
+			stories[s.ID] = true
+			valid.stories = append(valid.stories, s)
+		}
+	}
+	refs = nil
+	for _, a := range f.activities {
+		refs = append(refs, a.Story)
+	}
+	if err := addExisting(stories, "stories", refs, existing); err != nil {
+		return nil, nil, err
+	}
+
+	activities := map[string]bool{}
+	for i, a := range f.activities {
+		_, dateErr := time.Parse(time.RFC3339, a.Date)
+		switch {
+		case a.ID == "" || len(a.ID) > 24:
+			bad(activitiesFile, i, a.ID, "_id", "must be 1 to 24 characters")
+		case activities[a.ID]:
+			bad(activitiesFile, i, a.ID, "_id", "is a duplicate")
+		case !isAction(a.Action):
+			bad(activitiesFile, i, a.ID, "action",
+				fmt.Sprintf("unsupported action %q", a.Action))
+		case dateErr != nil:
+			bad(activitiesFile, i, a.ID, "date", "must be an RFC 3339 date")
+		case !users[a.Actor]:
+			bad(activitiesFile, i, a.ID, "actor",
+				fmt.Sprintf("unknown user %q", a.Actor))
+		case (a.Action == ActionFollow || a.Action == ActionUnfollow) &&
+			a.User2 == "":
+			bad(activitiesFile, i, a.ID, "user2",
+				"is required for follow and unfollow")
+		case a.Story == "" && needsStory(a.Action):
+			bad(activitiesFile, i, a.ID, "story",
+				fmt.Sprintf("is required for %s", a.Action))
+		case a.User2 != "" && !users[a.User2]:
+			bad(activitiesFile, i, a.ID, "user2",
+				fmt.Sprintf("unknown user %q", a.User2))
+		case a.Story != "" && !stories[a.Story]:
+			bad(activitiesFile, i, a.ID, "story",
+				fmt.Sprintf("unknown story %q", a.Story))
+		default:
+			activities[a.ID] = true
+			valid.activities = append(valid.activities, a)
+		}
+	}
+	return valid, problems, nil
+}
+
+// addExisting adds the IDs in refs that exist in the table to known.
+func addExisting(known map[string]bool, table string, refs []string,
+	existing func(string, []string) (map[string]bool, error)) error {
+
+	var missing []string
+	for _, id := range refs {
+		if id != "" && !known[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 || existing == nil {
+		return nil
+	}
+	found, err := existing(table, missing)
+	if err != nil {
+		return err
+	}
+	for id := range found {
+		known[id] = true
+	}
+	return nil
+}
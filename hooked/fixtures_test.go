@@ -0,0 +1,97 @@
+package hooked
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFixtures(t *testing.T) {
+	f := &fixtureSet{
+		src: FixtureSource{Users: "fixtures/users.json",
+			Stories: "fixtures/stories.json", Activities: "activities.csv"},
+		users: []User{
+			{ID: "u1", FirstName: "Ann", LastName: "Ant"},
+			{ID: "u1", FirstName: "Bob", LastName: "Bee"},
+			{ID: "u2", FirstName: "", LastName: "Cat"},
+		},
+		stories: []Story{
+			{ID: "s1", Title: "One", Author: "u1"},
+			{ID: "s2", Title: "Two", Author: "u2"},
+			{ID: "s3", Title: "Three", Author: "old"},
+		},
+		activities: []Activity{
+			{ID: "a1", Action: ActionLove, Date: "2017-06-27T00:00:00Z",
+				Actor: "u1", Story: "s1"},
+			{ID: "a2", Action: ActionLove, Date: "2017-06-27T00:00:00Z",
+				Actor: "u1", Story: "s2"},
+			{ID: "a3", Action: ActionFollow, Date: "2017-06-27T00:00:00Z",
+				Actor: "u1"},
+			{ID: "a4", Action: ActionRead, Date: "2017-06-27T00:00:00Z",
+				Actor: "u1"},
+			{ID: "a5", Action: "dance", Date: "2017-06-27T00:00:00Z",
+				Actor: "u1"},
+			{ID: "a6", Action: ActionWrite, Date: "yesterday", Actor: "u1"},
+			{ID: "a1", Action: ActionWrite, Date: "2017-06-27T00:00:00Z",
+				Actor: "u1"},
+			{ID: "a7", Action: ActionFollow, Date: "2017-06-27T00:00:00Z",
+				Actor: "u1", User2: "old"},
+		},
+	}
+	// Only "old" is already in the database.
+	var asked []string
+	existing := func(table string, ids []string) (map[string]bool, error) {
+		asked = append(asked, table+":"+strings.Join(ids, ","))
+		found := map[string]bool{}
+		for _, id := range ids {
+			if id == "old" {
+				found[id] = true
+			}
+		}
+		return found, nil
+	}
+	valid, problems, err := f.validate(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"users.json[1] (u1) _id: is a duplicate",
+		"users.json[2] (u2) firstname: must be 1 to 40 characters",
+		// u2 was invalid, so their story is too.
+		`stories.json[1] (s2) author: unknown user "u2"`,
+		// And so is the love of it.
+		`activities.csv[1] (a2) story: unknown story "s2"`,
+		"activities.csv[2] (a3) user2: is required for follow and unfollow",
+		"activities.csv[3] (a4) story: is required for read",
+		`activities.csv[4] (a5) action: unsupported action "dance"`,
+		"activities.csv[5] (a6) date: must be an RFC 3339 date",
+		"activities.csv[6] (a1) _id: is a duplicate",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("got problems:\n%v\nwant %d", problems, len(want))
+	}
+	for i, p := range problems {
+		if p.Error() != want[i] {
+			t.Errorf("problem %d: got %q, want %q", i, p, want[i])
+		}
+	}
+	if len(valid.users) != 1 || len(valid.stories) != 2 ||
+		len(valid.activities) != 2 {
+		t.Errorf("got %d users, %d stories and %d activities, want 1, 2 and 2",
+			len(valid.users), len(valid.stories), len(valid.activities))
+	}
+	// Only what isn't in the fixtures is looked up.
+	if strings.Join(asked, " ") != "users:u2,old,old stories:s2" {
+		t.Errorf("looked up %v, want u2, old and s2", asked)
+	}
+
+	// Without a database, nothing is known but the fixtures.
+	_, problems, err = f.validate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != len(want)+2 {
+		t.Errorf("got %d problems with no database, want %d", len(problems),
+			len(want)+2)
+	}
+}
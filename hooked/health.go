@@ -0,0 +1,111 @@
+package hooked
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/domino14/cool-api/logging"
+)
+
+// ReadyTimeout bounds all of the readiness checks together.
+const ReadyTimeout = 3 * time.Second
+
+// BuildInfo describes the running binary, for /version. main fills it in
+// from variables set at link time.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// A ReadyCheck returns an error if a dependency isn't ready to serve.
+type ReadyCheck func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check ReadyCheck
+}
+
+// WithReadyCheck adds a check to /readyz, which only reports ready once
+// every check passes. If the push sender can check its backend, that
+// check is added automatically, as "push".
+func WithReadyCheck(name string, check ReadyCheck) Option {
+	return func(s *Server) {
+		s.checks = append(s.checks, namedCheck{name, check})
+	}
+}
+
+// WithBuildInfo sets what /version reports.
+func WithBuildInfo(b BuildInfo) Option {
+	return func(s *Server) { s.build = b }
+}
+
+// healthzHandler reports that the process is up. It checks nothing else,
+// so that a struggling database doesn't get the API restarted.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	sendSuccess(w)
+}
+
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyzHandler runs every readiness check at once, and responds 503 if
+// any of them fails.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), ReadyTimeout)
+	defer cancel()
+
+	ret := readiness{Ready: true, Checks: map[string]string{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range s.checks {
+		wg.Add(1)
+		go func(c namedCheck) {
+			defer wg.Done()
+			err := c.check(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logging.FromContext(ctx).Error("ready-check", "check", c.name,
+					"err", err)
+				ret.Ready = false
+				ret.Checks[c.name] = err.Error()
+				return
+			}
+			ret.Checks[c.name] = "ok"
+		}(c)
+	}
+	wg.Wait()
+
+	body, err := json.MarshalIndent(ret, "", "\t")
+	if err != nil {
+		sendErr(w, r, "marshal-readiness", err)
+		return
+	}
+	w.Header().Set("Content-Type", JSONContentType)
+	if !ret.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	b := s.build
+	if b.GoVersion == "" {
+		b.GoVersion = runtime.Version()
+	}
+	ret, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		sendErr(w, r, "marshal-version", err)
+		return
+	}
+	w.Header().Set("Content-Type", JSONContentType)
+	w.Write(ret)
+}
@@ -0,0 +1,153 @@
+package hooked
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/domino14/cool-api/logging"
+)
+
+// IdempotencyKeyHeader lets a client retry a request safely: a retry with
+// the same key gets the first response back, instead of being done again.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// DefaultIdempotencyTTL is how long idempotency keys are kept by default.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// An IdempotentRequest is a request made with an Idempotency-Key, and the
+// response it got.
+type IdempotentRequest struct {
+	// Owner is the ID of the API key the request was made with, or with
+	// auth off, "ip:" and the client's address. Keys are only unique per
+	// owner.
+	Owner string
+	Key   string
+	// Fingerprint is a hash of the request, to catch a key being reused
+	// for a different request.
+	Fingerprint string
+	Status      int
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// IdempotencyStore keeps the requests made with idempotency keys.
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey records req, without its response for now. If
+	// an unexpired request with the same owner and key is already
+	// recorded, it returns that instead. Call it inside Atomic, so that
+	// concurrent requests with the same key wait for each other.
+	ClaimIdempotencyKey(ctx context.Context, req *IdempotentRequest) (
+		*IdempotentRequest, error)
+	// GetIdempotentRequest returns the unexpired request recorded with the
+	// owner and key, or nil if there isn't one.
+	GetIdempotentRequest(ctx context.Context, owner, key string) (
+		*IdempotentRequest, error)
+	// SetIdempotentResponse records the response to a claimed request.
+	SetIdempotentResponse(ctx context.Context, req *IdempotentRequest) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context) (int, error)
+}
+
+// maxIdempotencyKey is the longest key we accept.
+const maxIdempotencyKey = 255
+
+// idempotencySweepInterval is how often expired idempotency keys are
+// deleted.
+const idempotencySweepInterval = time.Hour
+
+// idempotencyOwner returns who owns the request's idempotency key: the
+// API key it was made with. With auth off there isn't one, so it's the
+// client's address instead, so that different clients' keys don't clash.
+// Clients behind a proxy are only told apart if the proxy is trusted by
+// the rate limits.
+func (s *Server) idempotencyOwner(r *http.Request) string {
+	if k, ok := APIKeyFromContext(r.Context()); ok {
+		return k.ID
+	}
+	return "ip:" + s.limits.clientIP(r)
+}
+
+// isReplay reports whether the request has an idempotency key that
+// already has a response, which the handler will send again. Replays
+// aren't rate limited, since they don't do anything.
+func (s *Server) isReplay(r *http.Request) bool {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" || len(key) > maxIdempotencyKey {
+		return false
+	}
+	prev, err := s.store.GetIdempotentRequest(r.Context(),
+		s.idempotencyOwner(r), key)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("get-idempotent-request",
+			"err", err)
+		return false
+	}
+	return prev != nil && prev.Status != 0
+}
+
+// idempotentRequest returns the request to record for r, whose body is
+// body, or nil if it has no idempotency key. It answers 400 and returns
+// false if the key is bad.
+func (s *Server) idempotentRequest(w http.ResponseWriter, r *http.Request,
+	body []byte) (*IdempotentRequest, bool) {
+
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		return nil, true
+	}
+	if len(key) > maxIdempotencyKey {
+		sendError(w, http.StatusBadRequest, CodeBadRequest,
+			"Idempotency-Key may be at most 255 characters.")
+		return nil, false
+	}
+	s.sweepIdempotencyKeys(r.Context())
+	req := &IdempotentRequest{
+		Owner:     s.idempotencyOwner(r),
+		Key:       key,
+		ExpiresAt: time.Now().Add(s.idempotencyTTL),
+	}
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	req.Fingerprint = hex.EncodeToString(h.Sum(nil))
+	return req, true
+}
+
+// replayResponse sends prev's response again, as the response to req. If
+// req isn't the same request as prev, it answers 422 instead.
+func replayResponse(w http.ResponseWriter, r *http.Request,
+	req, prev *IdempotentRequest) {
+
+	if prev.Fingerprint != req.Fingerprint {
+		sendError(w, http.StatusUnprocessableEntity, CodeKeyReused,
+			"This Idempotency-Key was already used for a different request.")
+		return
+	}
+	logging.FromContext(r.Context()).Debug("Replaying response",
+		"idempotency_key", req.Key)
+	w.Header().Set("Content-Type", JSONContentType)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(prev.Status)
+	w.Write(prev.Body)
+}
+
+// sweepIdempotencyKeys deletes the expired idempotency keys, at most once
+// every idempotencySweepInterval.
+func (s *Server) sweepIdempotencyKeys(ctx context.Context) {
+	s.sweepMu.Lock()
+	if time.Since(s.swept) < idempotencySweepInterval {
+		s.sweepMu.Unlock()
+		return
+	}
+	s.swept = time.Now()
+	s.sweepMu.Unlock()
+	n, err := s.store.DeleteExpiredIdempotencyKeys(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Error("sweep-idempotency-keys", "err", err)
+		return
+	}
+	logging.FromContext(ctx).Debug("Deleted expired idempotency keys",
+		"count", n)
+}
@@ -0,0 +1,114 @@
+package hooked
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	love    = `{"action":"love","actor":"u1","story":"s1"}`
+	comment = `{"action":"comment","actor":"u1","story":"s1"}`
+)
+
+// postFrom posts body to /activity from the client at addr, with the
+// idempotency key.
+func postFrom(h http.Handler, addr, key,
+	body string) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest("POST", "/activity", strings.NewReader(body))
+	r.RemoteAddr = addr + ":1234"
+	r.Header.Set(IdempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// notified returns how many notifications u2 has.
+func notified(t *testing.T, m *MemoryStore) int {
+	t.Helper()
+	page, err := m.GetNotifications(context.Background(), &User{ID: "u2"},
+		NotificationQuery{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(page.Notifications)
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	m := newTestMemoryStore(t)
+	h := newTestServer(t, m)
+	first := postFrom(h, "192.0.2.1", "k1", love)
+	if first.Code != http.StatusOK ||
+		first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first POST: status %d, headers %v", first.Code,
+			first.Header())
+	}
+	again := postFrom(h, "192.0.2.1", "k1", love)
+	if again.Code != first.Code || again.Body.String() != first.Body.String() ||
+		again.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: got %d %s, headers %v; want the first response "+
+			"replayed", again.Code, again.Body, again.Header())
+	}
+	if n := notified(t, m); n != 1 {
+		t.Errorf("u2 has %d notifications, want the one", n)
+	}
+
+	// The same key for something else is refused.
+	w := postFrom(h, "192.0.2.1", "k1", comment)
+	var res ErrorResponse
+	decode(t, w, &res)
+	if w.Code != http.StatusUnprocessableEntity ||
+		res.Error.Code != CodeKeyReused {
+		t.Errorf("reused key: got %d %s, want 422 %s", w.Code, w.Body,
+			CodeKeyReused)
+	}
+
+	// With auth off, each client address has its own keys.
+	w = postFrom(h, "192.0.2.2", "k1", love)
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another client's key: got %d, headers %v; want it saved",
+			w.Code, w.Header())
+	}
+	if n := notified(t, m); n != 2 {
+		t.Errorf("u2 has %d notifications, want 2", n)
+	}
+
+	// A request that fails doesn't use up its key.
+	if w := postFrom(h, "192.0.2.1", "k2", `{"action":"love"}`); w.Code !=
+		http.StatusUnprocessableEntity {
+		t.Fatalf("bad activity: status %d, want 422", w.Code)
+	}
+	w = postFrom(h, "192.0.2.1", "k2", love)
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("after a failure: got %d, headers %v; want it saved", w.Code,
+			w.Header())
+	}
+}
+
+func TestIdempotencyKeysExpire(t *testing.T) {
+	m := newTestMemoryStore(t)
+	h := newTestServer(t, m, WithIdempotencyTTL(10*time.Millisecond))
+	if w := postFrom(h, "192.0.2.1", "k1", love); w.Code != http.StatusOK {
+		t.Fatalf("POST: status %d: %s", w.Code, w.Body)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// Once the key has expired, it can be used again, even for something
+	// else.
+	w := postFrom(h, "192.0.2.1", "k1", comment)
+	if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expired key: got %d %s, headers %v; want it saved", w.Code,
+			w.Body, w.Header())
+	}
+	if n := notified(t, m); n != 2 {
+		t.Errorf("u2 has %d notifications, want 2", n)
+	}
+
+	w = postFrom(h, "192.0.2.1", strings.Repeat("k", maxIdempotencyKey+1), love)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a long key: status %d, want 400", w.Code)
+	}
+}
@@ -1,116 +1,369 @@
 package hooked
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"sort"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/satori/go.uuid"
 )
 
-func getModels() ([]Activity, []Story, []User) {
-	dat, err := ioutil.ReadFile("./fixtures/activities.json")
+// readFixtures reads every record in the source's files.
+func readFixtures(src FixtureSource) (*fixtureSet, error) {
+	f := &fixtureSet{src: src}
+	err := readRecords(src.Users, func(d recordDecoder) error {
+		var u User
+		if err := d.Next(&u); err != nil {
+			return err
+		}
+		f.users = append(f.users, u)
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	var activities []Activity
-	err = json.Unmarshal(dat, &activities)
+	err = readRecords(src.Stories, func(d recordDecoder) error {
+		var s Story
+		if err := d.Next(&s); err != nil {
+			return err
+		}
+		f.stories = append(f.stories, s)
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	dat, err = ioutil.ReadFile("./fixtures/stories.json")
-	var stories []Story
-	err = json.Unmarshal(dat, &stories)
+	err = readRecords(src.Activities, func(d recordDecoder) error {
+		var a Activity
+		if err := d.Next(&a); err != nil {
+			return err
+		}
+		f.activities = append(f.activities, a)
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return f, nil
+}
+
+// SeedOptions controls what LoadFixtures does with existing data.
+type SeedOptions struct {
+	// Source is where to read the fixtures from.
+	Source FixtureSource
+	// Reset deletes all existing data first.
+	Reset bool
+	// Upsert overwrites users, stories and activities that already exist.
+	// Otherwise they are left alone.
+	Upsert bool
+	// Strict refuses to load anything if any fixture row is bad. Otherwise
+	// bad rows are skipped, and listed in the report.
+	Strict bool
+}
 
-	dat, err = ioutil.ReadFile("./fixtures/users.json")
-	var users []User
-	err = json.Unmarshal(dat, &users)
+// LoadFixtures loads the fixtures. It is idempotent: loading the same
+// fixtures twice doesn't duplicate anything, and notifications are only
+// computed for activities that weren't there before. Those are created by
+// the same rules as for activities posted to the API, so pass the same
+// store options as the API uses.
+//
+// The fixtures are validated before anything is written. In strict mode a
+// bad row fails the whole load with FixtureErrors; otherwise it's skipped.
+// Database errors always fail the load, but each table is loaded in its
+// own transaction, so tables before the failing one stay loaded.
+func LoadFixtures(db *sql.DB, opts SeedOptions,
+	storeOpts ...StoreOption) (*SeedReport, error) {
+	all, err := readFixtures(opts.Source)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return activities, stories, users
-}
+	existing := func(table string, ids []string) (map[string]bool, error) {
+		return existingIDs(db, table, ids)
+	}
+	if opts.Reset {
+		// Everything is about to go.
+		existing = nil
+	}
+	f, problems, err := all.validate(existing)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Strict && len(problems) > 0 {
+		return nil, problems
+	}
+	report := &SeedReport{Problems: problems}
+	report.Users.Read = len(all.users)
+	report.Users.Invalid = len(all.users) - len(f.users)
+	report.Stories.Read = len(all.stories)
+	report.Stories.Invalid = len(all.stories) - len(f.stories)
+	report.Activities.Read = len(all.activities)
+	report.Activities.Invalid = len(all.activities) - len(f.activities)
 
-// LoadFixtures destructively loads fixtures, wiping the slate every time.
-func LoadFixtures(db *sql.DB) {
-	activities, stories, users := getModels()
-	db.Exec("DELETE from followers")
-	db.Exec("DELETE from notifications")
-	db.Exec("DELETE from activities")
-	db.Exec("DELETE from stories")
-	db.Exec("DELETE from users")
-
-	tx, _ := db.Begin()
-	stmt, _ := tx.Prepare(`
+	if opts.Reset {
+		err = inTx(db, func(tx *sql.Tx) error {
+			// Referencing tables go before the ones they reference.
+			for _, table := range []string{"push_outbox", "notification_reads",
+				"followers", "notifications", "activities", "stories",
+				"api_keys", "idempotency_keys", "rate_limits", "users"} {
+				if _, err := tx.Exec("DELETE from " + table); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	onConflict := "DO NOTHING"
+	if opts.Upsert {
+		onConflict = `DO UPDATE SET
+            firstname = EXCLUDED.firstname, lastname = EXCLUDED.lastname`
+	}
+	rows := make([][]interface{}, len(f.users))
+	for i, user := range f.users {
+		rows[i] = []interface{}{user.ID, user.FirstName, user.LastName}
+	}
+	_, err = upsertAll(db, &report.Users, `
             INSERT INTO users (sid, firstname, lastname)
             VALUES ($1, $2, $3)
-        `)
-	for _, user := range users {
-		stmt.Exec(user.ID, user.FirstName, user.LastName)
+            ON CONFLICT (sid) `+onConflict, rows)
+	if err != nil {
+		return nil, err
 	}
-	tx.Commit()
 
-	tx, _ = db.Begin()
-	stmt, _ = tx.Prepare(`
+	if opts.Upsert {
+		onConflict = `DO UPDATE SET
+            title = EXCLUDED.title, author_id = EXCLUDED.author_id`
+	}
+	rows = make([][]interface{}, len(f.stories))
+	for i, story := range f.stories {
+		rows[i] = []interface{}{story.ID, story.Title, story.Author}
+	}
+	_, err = upsertAll(db, &report.Stories, `
             INSERT INTO stories (sid, title, author_id)
             VALUES ($1, $2, $3)
-        `)
-	for _, story := range stories {
-		stmt.Exec(story.ID, story.Title, story.Author)
+            ON CONFLICT (sid) `+onConflict, rows)
+	if err != nil {
+		return nil, err
 	}
-	tx.Commit()
 
-	tx, _ = db.Begin()
-	stmt, _ = tx.Prepare(`
-            INSERT INTO activities (sid, action, date, actor_id, user2_id)
-            VALUES ($1, $2, $3, $4, $5)
-            `)
-	for _, activity := range activities {
-		stmt.Exec(activity.ID, activity.Action, activity.Date, activity.Actor,
-			activity.User2)
+	if opts.Upsert {
+		onConflict = `DO UPDATE SET
+            action = EXCLUDED.action, date = EXCLUDED.date,
+            actor_id = EXCLUDED.actor_id, user2_id = EXCLUDED.user2_id,
+            story_id = EXCLUDED.story_id`
+	}
+	rows = make([][]interface{}, len(f.activities))
+	for i, activity := range f.activities {
+		rows[i] = []interface{}{activity.ID, activity.Action, activity.Date,
+			activity.Actor, nullable(activity.User2), nullable(activity.Story)}
+	}
+	inserted, err := upsertAll(db, &report.Activities, `
+            INSERT INTO activities
+            (sid, action, date, actor_id, user2_id, story_id)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (sid) `+onConflict, rows)
+	if err != nil {
+		return nil, err
+	}
+	var added []Activity
+	for i, activity := range f.activities {
+		if inserted[i] {
+			added = append(added, activity)
+		}
 	}
-	tx.Commit()
 
-	// Now pre-compute notifications table from existing activities,
+	// Now replay the new activities through the same rules as live ones,
 	// so we can begin querying the API right away.
-	preComputeNotifications(db, activities)
-	preComputeFollowers(db, activities)
+	report.Notifications, report.Followers, err = replayActivities(db, added,
+		storeOpts)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
 }
 
-// Pre-calculate notifications from initial fixtures. Since all activities
-// in fixtures are just `follow`, the initial notifications in this table
-// will be very similar to the notifications in the activities table.
-func preComputeNotifications(db *sql.DB, activities []Activity) {
-	tx, _ := db.Begin()
-	stmt, _ := tx.Prepare(`
-        INSERT INTO notifications (id, notified_id, actor_id, action, story_id, date)
-        VALUES ($1, $2, $3, $4, $5, $6)
-    `)
-	// Add notification to followed user (user2)
-	for _, activity := range activities {
-		stmt.Exec(uuid.NewV4(),
-			activity.User2, activity.Actor, activity.Action, nil, activity.Date)
+// inTx runs fn in a transaction.
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
-	tx.Commit()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// upsertAll runs the INSERT ... ON CONFLICT statement for each row in one
+// transaction, counting inserts and updates in t. It returns which rows
+// were inserted.
+func upsertAll(db *sql.DB, t *TableReport, stmt string,
+	rows [][]interface{}) ([]bool, error) {
+
+	inserted := make([]bool, len(rows))
+	err := inTx(db, func(tx *sql.Tx) error {
+		// xmax is 0 for freshly inserted rows, and set for updated ones.
+		// Rows left alone by DO NOTHING aren't returned at all.
+		prepared, err := tx.Prepare(stmt + " RETURNING xmax = 0")
+		if err != nil {
+			return err
+		}
+		defer prepared.Close()
+		for i, row := range rows {
+			var isInsert bool
+			err := prepared.QueryRow(row...).Scan(&isInsert)
+			switch {
+			case err == sql.ErrNoRows:
+			case err != nil:
+				return fmt.Errorf("row %v: %v", row[0], err)
+			case isInsert:
+				inserted[i] = true
+				t.Inserted++
+			default:
+				t.Updated++
+			}
+		}
+		return nil
+	})
+	return inserted, err
+}
+
+// existingIDs returns which of the IDs are in the table.
+func existingIDs(db *sql.DB, table string, ids []string) (map[string]bool,
+	error) {
+
+	rows, err := db.Query("SELECT sid FROM "+table+" WHERE sid = ANY($1)",
+		pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+	return found, rows.Err()
 }
 
-func preComputeFollowers(db *sql.DB, activities []Activity) {
-	tx, _ := db.Begin()
-	// The test fixtures have at least one duplicate follow event,
-	// so add the DO NOTHING below :)
-	stmt, _ := tx.Prepare(`
-        INSERT INTO followers (user_id, follower_id)
-        VALUES ($1, $2)
+// replayActivities creates the notifications and followers for activities
+// that were just loaded, oldest first, as if they had been posted to the
+// API. It returns how many notifications and followers it added. No push
+// notifications are sent.
+func replayActivities(db *sql.DB, activities []Activity,
+	storeOpts []StoreOption) (notifications, followers int, err error) {
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		// The dates were validated already.
+		a, _ := time.Parse(time.RFC3339, activities[i].Date)
+		b, _ := time.Parse(time.RFC3339, activities[j].Date)
+		return a.Before(b)
+	})
+	ctx := context.Background()
+	err = NewPostgresStore(db, storeOpts...).Atomic(ctx, func(tx Store) error {
+		q := tx.(*pgStore).q
+		var n0, f0, n1, f1 int
+		err := q.QueryRowContext(ctx, `
+            SELECT (SELECT count(*) FROM notifications),
+                (SELECT count(*) FROM followers)
+        `).Scan(&n0, &f0)
+		if err != nil {
+			return err
+		}
+		// Fixtures are mostly follows, so runs of them are written with
+		// COPY rather than a row at a time. The run is flushed before any
+		// other activity, which may depend on who follows whom by then.
+		var follows followBatch
+		for i := range activities {
+			a := &activities[i]
+			if a.Action == ActionFollow {
+				follows.add(a)
+				continue
+			}
+			if err := follows.flush(ctx, q); err != nil {
+				return err
+			}
+			if err := createNotifications(ctx, tx, a); err != nil {
+				return fmt.Errorf("activity %s: %v", a.ID, err)
+			}
+		}
+		if err := follows.flush(ctx, q); err != nil {
+			return err
+		}
+		err = q.QueryRowContext(ctx, `
+            SELECT (SELECT count(*) FROM notifications),
+                (SELECT count(*) FROM followers)
+        `).Scan(&n1, &f1)
+		notifications, followers = n1-n0, f1-f0
+		return err
+	})
+	return notifications, followers, err
+}
+
+// followBatch collects the notifications and follower rows for a run of
+// follow activities, the same ones createNotifications would make.
+type followBatch struct {
+	notifications [][]interface{}
+	followers     [][]interface{}
+	loadTable     bool
+}
+
+func (b *followBatch) add(a *Activity) {
+	b.notifications = append(b.notifications, []interface{}{
+		uuid.NewV4().String(), a.User2, a.Actor, a.Action, a.Date, nil, a.ID})
+	b.followers = append(b.followers, []interface{}{a.User2, a.Actor, a.Date})
+}
+
+// flush writes the batch out, and empties it.
+func (b *followBatch) flush(ctx context.Context, q querier) error {
+	if len(b.followers) == 0 {
+		return nil
+	}
+	err := copyIn(ctx, q, "notifications", []string{
+		"id", "notified_id", "actor_id", "action", "date", "story_id",
+		"activity_id",
+	}, b.notifications)
+	if err != nil {
+		return err
+	}
+	// COPY can't skip follows that are already there, so they go through
+	// a temporary table.
+	if !b.loadTable {
+		_, err = q.ExecContext(ctx, `
+            CREATE TEMP TABLE followers_load
+            (LIKE followers INCLUDING DEFAULTS) ON COMMIT DROP
+        `)
+		if err != nil {
+			return err
+		}
+		b.loadTable = true
+	}
+	err = copyIn(ctx, q, "followers_load",
+		[]string{"user_id", "follower_id", "since"}, b.followers)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `
+        INSERT INTO followers (user_id, follower_id, since)
+        SELECT user_id, follower_id, since FROM followers_load
         ON CONFLICT DO NOTHING
     `)
-
-	// Add notification to followed user (user2)
-	for _, activity := range activities {
-		stmt.Exec(activity.User2, activity.Actor)
+	if err != nil {
+		return err
+	}
+	if _, err = q.ExecContext(ctx, "DELETE FROM followers_load"); err != nil {
+		return err
 	}
-	tx.Commit()
+	b.notifications, b.followers = nil, nil
+	return nil
 }
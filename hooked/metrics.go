@@ -0,0 +1,257 @@
+package hooked
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/domino14/cool-api/push"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	activitiesSaved = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hooked_activities_total",
+		Help: "Activities saved, by action.",
+	}, []string{"action"})
+	fanoutSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "hooked_fanout_followers",
+		Help:    "Followers notified about each activity.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hooked_store_duration_seconds",
+		Help:    "How long store calls take, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hooked_http_request_duration_seconds",
+		Help:    "How long HTTP requests take, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hooked_rate_limited_total",
+		Help: "Requests turned away by the rate limits, by ip or actor.",
+	}, []string{"scope"})
+)
+
+// InstrumentStore wraps s so that every call to it is timed in the
+// hooked_store_duration_seconds metric. Atomic is timed as a whole, and
+// the calls inside it individually.
+func InstrumentStore(s Store) Store {
+	return instrumentedStore{s}
+}
+
+type instrumentedStore struct {
+	s Store
+}
+
+// observe records how long since start for the method.
+func observe(method string, start time.Time) {
+	storeDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+func (i instrumentedStore) Atomic(ctx context.Context,
+	fn func(Store) error) error {
+
+	defer observe("Atomic", time.Now())
+	return i.s.Atomic(ctx, func(tx Store) error {
+		return fn(instrumentedStore{tx})
+	})
+}
+
+func (i instrumentedStore) GetUser(ctx context.Context, id string) (*User,
+	error) {
+
+	defer observe("GetUser", time.Now())
+	return i.s.GetUser(ctx, id)
+}
+
+func (i instrumentedStore) GetStory(ctx context.Context, id string) (*Story,
+	error) {
+
+	defer observe("GetStory", time.Now())
+	return i.s.GetStory(ctx, id)
+}
+
+func (i instrumentedStore) InsertActivity(ctx context.Context,
+	a *Activity) error {
+
+	defer observe("InsertActivity", time.Now())
+	return i.s.InsertActivity(ctx, a)
+}
+
+func (i instrumentedStore) GetActivity(ctx context.Context, id string) (
+	*Activity, error) {
+
+	defer observe("GetActivity", time.Now())
+	return i.s.GetActivity(ctx, id)
+}
+
+func (i instrumentedStore) FindActivities(ctx context.Context,
+	actor, action, story string) ([]string, error) {
+
+	defer observe("FindActivities", time.Now())
+	return i.s.FindActivities(ctx, actor, action, story)
+}
+
+func (i instrumentedStore) DeleteActivity(ctx context.Context,
+	id string) error {
+
+	defer observe("DeleteActivity", time.Now())
+	return i.s.DeleteActivity(ctx, id)
+}
+
+func (i instrumentedStore) GetFollowerIDs(ctx context.Context, id string) (
+	[]string, error) {
+
+	defer observe("GetFollowerIDs", time.Now())
+	return i.s.GetFollowerIDs(ctx, id)
+}
+
+func (i instrumentedStore) AddFollower(ctx context.Context,
+	userID, followerID, since string) error {
+
+	defer observe("AddFollower", time.Now())
+	return i.s.AddFollower(ctx, userID, followerID, since)
+}
+
+func (i instrumentedStore) RemoveFollower(ctx context.Context,
+	userID, followerID string) error {
+
+	defer observe("RemoveFollower", time.Now())
+	return i.s.RemoveFollower(ctx, userID, followerID)
+}
+
+func (i instrumentedStore) GetNotifications(ctx context.Context, user *User,
+	q NotificationQuery) (*NotificationPage, error) {
+
+	defer observe("GetNotifications", time.Now())
+	return i.s.GetNotifications(ctx, user, q)
+}
+
+func (i instrumentedStore) AddNotifications(ctx context.Context,
+	notifiedIDs []string, n Notification) error {
+
+	defer observe("AddNotifications", time.Now())
+	return i.s.AddNotifications(ctx, notifiedIDs, n)
+}
+
+func (i instrumentedStore) DeleteNotifications(ctx context.Context,
+	notifiedID, actorID, action string) (int, error) {
+
+	defer observe("DeleteNotifications", time.Now())
+	return i.s.DeleteNotifications(ctx, notifiedID, actorID, action)
+}
+
+func (i instrumentedStore) FanOut(ctx context.Context, a *Activity,
+	n Notification) (int, error) {
+
+	defer observe("FanOut", time.Now())
+	return i.s.FanOut(ctx, a, n)
+}
+
+func (i instrumentedStore) CountUnread(ctx context.Context, user *User) (int,
+	error) {
+
+	defer observe("CountUnread", time.Now())
+	return i.s.CountUnread(ctx, user)
+}
+
+func (i instrumentedStore) MarkRead(ctx context.Context, user *User,
+	ids []string) (int, error) {
+
+	defer observe("MarkRead", time.Now())
+	return i.s.MarkRead(ctx, user, ids)
+}
+
+func (i instrumentedStore) MarkReadUpTo(ctx context.Context, user *User,
+	c Cursor) (int, error) {
+
+	defer observe("MarkReadUpTo", time.Now())
+	return i.s.MarkReadUpTo(ctx, user, c)
+}
+
+func (i instrumentedStore) QueuePush(ctx context.Context,
+	msgs ...push.Message) error {
+
+	defer observe("QueuePush", time.Now())
+	return i.s.QueuePush(ctx, msgs...)
+}
+
+func (i instrumentedStore) GetAPIKey(ctx context.Context, hash string) (
+	*APIKey, error) {
+
+	defer observe("GetAPIKey", time.Now())
+	return i.s.GetAPIKey(ctx, hash)
+}
+
+func (i instrumentedStore) AddAPIKey(ctx context.Context, k *APIKey) error {
+	defer observe("AddAPIKey", time.Now())
+	return i.s.AddAPIKey(ctx, k)
+}
+
+func (i instrumentedStore) RevokeAPIKey(ctx context.Context, id string) error {
+	defer observe("RevokeAPIKey", time.Now())
+	return i.s.RevokeAPIKey(ctx, id)
+}
+
+func (i instrumentedStore) ClaimIdempotencyKey(ctx context.Context,
+	req *IdempotentRequest) (*IdempotentRequest, error) {
+
+	defer observe("ClaimIdempotencyKey", time.Now())
+	return i.s.ClaimIdempotencyKey(ctx, req)
+}
+
+func (i instrumentedStore) GetIdempotentRequest(ctx context.Context,
+	owner, key string) (*IdempotentRequest, error) {
+
+	defer observe("GetIdempotentRequest", time.Now())
+	return i.s.GetIdempotentRequest(ctx, owner, key)
+}
+
+func (i instrumentedStore) SetIdempotentResponse(ctx context.Context,
+	req *IdempotentRequest) error {
+
+	defer observe("SetIdempotentResponse", time.Now())
+	return i.s.SetIdempotentResponse(ctx, req)
+}
+
+func (i instrumentedStore) DeleteExpiredIdempotencyKeys(
+	ctx context.Context) (int, error) {
+
+	defer observe("DeleteExpiredIdempotencyKeys", time.Now())
+	return i.s.DeleteExpiredIdempotencyKeys(ctx)
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// metricsMiddleware times each request, labeled by its route template
+// rather than its path, so that user IDs don't each get a time series.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		route := "unknown"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		httpDuration.WithLabelValues(route, r.Method,
+			strconv.Itoa(rec.code)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -1,24 +1,44 @@
 package hooked
 
 import (
-	"database/sql"
+	"context"
 	"errors"
-	"log"
 	"strings"
 	"time"
 
+	"github.com/domino14/cool-api/logging"
 	"github.com/domino14/cool-api/push"
 	"github.com/satori/go.uuid"
 )
 
 const (
-	ActionFollow  = "follow"
-	ActionLove    = "love"
-	ActionRead    = "read"
-	ActionWrite   = "write"
-	ActionComment = "comment"
+	ActionFollow   = "follow"
+	ActionUnfollow = "unfollow"
+	ActionLove     = "love"
+	ActionUnlove   = "unlove"
+	ActionRead     = "read"
+	ActionWrite    = "write"
+	ActionComment  = "comment"
 )
 
+func isAction(action string) bool {
+	switch action {
+	case ActionFollow, ActionUnfollow, ActionLove, ActionUnlove, ActionRead,
+		ActionWrite, ActionComment:
+		return true
+	}
+	return false
+}
+
+// needsStory reports whether activities with the action are about a story.
+func needsStory(action string) bool {
+	switch action {
+	case ActionLove, ActionUnlove, ActionComment, ActionRead:
+		return true
+	}
+	return false
+}
+
 type User struct {
 	FirstName string `json:"firstname"`
 	LastName  string `json:"lastname"`
@@ -42,14 +62,27 @@ type Activity struct {
 	User2  string `json:"user2"`
 	ID     string `json:"_id"`
 	Story  string `json:"story"`
+	// Retract is for unfollows: it also deletes the notification(s) that
+	// the followed user got about the follow.
+	Retract bool `json:"retract,omitempty"`
 }
 
 type Notification struct {
+	ID     string `json:"id"`
 	Action string `json:"action"`
 	Actor  string `json:"actor"`
 	Story  string `json:"story,omitempty"`
 	User2  string `json:"user2,omitempty"`
 	Date   string `json:"date"`
+	// ReadAt is when the user read the notification, if they have.
+	ReadAt string `json:"read_at,omitempty"`
+
+	// The activity that made the notification, so that deleting the
+	// activity can delete it too.
+	activityID string
+
+	// The exact date, for making cursors.
+	at time.Time
 }
 
 // Generate a 24-character ID. The fixtures use 24-character IDs so
@@ -68,155 +101,178 @@ func now() string {
 }
 
 // Validate validates the activity, checking for various heuristics,
-// prior to saving it to the database.
-func (a *Activity) Validate(db *sql.DB) error {
-
-	switch a.Action {
-	case ActionFollow, ActionLove, ActionRead, ActionWrite, ActionComment:
-	default:
-		return errors.New(
-			"Must provide a supported action: follow, love, read, write, comment.")
+// prior to saving it to the database. Problems with the activity are
+// returned together in a *ValidationError.
+func (a *Activity) Validate(ctx context.Context, s Store) error {
+	v := &ValidationError{}
+	// A reference to a missing user or story is the client's problem, but
+	// any other error is ours.
+	check := func(field string, err error) error {
+		if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrStoryNotFound) {
+			v.add(field, err.Error())
+			return nil
+		}
+		return err
 	}
 
-	if a.Actor == "" {
-		return errors.New("Must provide an actor.")
+	if !isAction(a.Action) {
+		v.add("action",
+			"Must provide a supported action: follow, unfollow, love, "+
+				"unlove, read, write, comment.")
 	}
 
-	_, err := getUser(db, a.Actor)
-	if err != nil {
-		return err
+	if a.Actor == "" {
+		v.add("actor", "Must provide an actor.")
+	} else {
+		_, err := s.GetUser(ctx, a.Actor)
+		if err := check("actor", err); err != nil {
+			return err
+		}
 	}
 	if a.Action == ActionFollow && a.User2 == "" {
-		return errors.New("Must provide a user to follow.")
+		v.add("user2", "Must provide a user to follow.")
+	}
+	if a.Action == ActionUnfollow && a.User2 == "" {
+		v.add("user2", "Must provide a user to unfollow.")
+	}
+	if a.Retract && a.Action != ActionUnfollow {
+		v.add("retract", "retract is only for unfollows.")
 	}
 	if a.User2 != "" {
-		_, err = getUser(db, a.User2)
-		if err != nil {
+		_, err := s.GetUser(ctx, a.User2)
+		if err := check("user2", err); err != nil {
 			return err
 		}
 	}
 
 	if a.Story != "" {
-		_, err := getStory(db, a.Story)
-		if err != nil {
+		_, err := s.GetStory(ctx, a.Story)
+		if err := check("story", err); err != nil {
 			return err
 		}
-	} else {
-		if a.Action == ActionLove || a.Action == ActionComment || a.Action == ActionRead {
-			return errors.New("You must provide a story ID for this action")
-		}
+	} else if needsStory(a.Action) {
+		v.add("story", "You must provide a story ID for this action")
 	}
-	return nil
+	return v.err()
 }
 
-func saveActivity(db *sql.DB, a *Activity) error {
-	// Go is a bit verbose
-	var story, user2 interface{}
-	if a.Story == "" {
-		story = nil
-	} else {
-		story = a.Story
-	}
-	if a.User2 == "" {
-		user2 = nil
-	} else {
-		user2 = a.User2
-	}
-	//
-	_, err := db.Query(`
-        INSERT into activities (sid, action, date, actor_id, user2_id, story_id)
-        VALUES($1, $2, $3, $4, $5, $6)
-    `, genID(), a.Action, now(), a.Actor, user2, story)
-	return err
-}
-
-func createNotifications(db *sql.DB, a *Activity) error {
+func createNotifications(ctx context.Context, s Store, a *Activity) error {
 	// Generate the notifications.
 	/*
 	   - user follows another user
 	       - add notification to followed user
+	   - user unfollows another user
+	       - remove actor from the user's followers, and if asked, take
+	         back the follow notification
 	   - user reads a story
 	       - add notification to actor’s followers
 	   - user loves a story
 	       - add notification to actor’s followers
+	   - user unloves a story
+	       - delete the love, and the notifications it made
 	   - user writes a story
 	       - add notification to all followers
 	   - user comments on a story
 	       - add notification to actor’s followers
 	*/
-	var err error
+	n := Notification{
+		Action:     a.Action,
+		Actor:      a.Actor,
+		Date:       a.Date,
+		activityID: a.ID,
+	}
 	switch a.Action {
 	case ActionFollow:
 		// Add notification to followed user.
-		_, err = db.Query(`
-	           INSERT into notifications (id, notified_id, actor_id, action, date)
-               VALUES ($1, $2, $3, $4, $5)
-        `, uuid.NewV4(), a.User2, a.Actor, a.Action, now())
+		err := s.AddNotifications(ctx, []string{a.User2}, n)
 		if err != nil {
 			return err
 		}
 		// Also add to followers table
-		_, err = db.Query(`
-            INSERT INTO followers (user_id, follower_id)
-            VALUES ($1, $2)
-            ON CONFLICT DO NOTHING
-        `, a.User2, a.Actor)
-		if err != nil {
+		return s.AddFollower(ctx, a.User2, a.Actor, a.Date)
+	case ActionUnfollow:
+		// Nobody is told about unfollows, but the activity is kept. Once
+		// the row is gone, the user's activities no longer fan out to the
+		// former follower.
+		if err := s.RemoveFollower(ctx, a.User2, a.Actor); err != nil {
 			return err
 		}
-		// no need for break, switch doesn't fallthrough in Go
-	case ActionRead, ActionLove /* 😍 */, ActionWrite, ActionComment:
-		// Add notification to actor's followers.
-		followers, err := getFollowerIDs(db, a.Actor)
+		if !a.Retract {
+			return nil
+		}
+		n, err := s.DeleteNotifications(ctx, a.User2, a.Actor, ActionFollow)
 		if err != nil {
 			return err
 		}
-		log.Printf("[DEBUG] Action=%v, adding %v notifications to followers",
-			a.Action, len(followers))
-		var story interface{}
-		story = a.Story
-		if a.Action == ActionWrite {
-			// No spec for creating a new story, so for now let's set it to NULL
-			story = nil
+		logging.FromContext(ctx).Debug("Retracted follow notifications",
+			"user", a.User2, "count", n)
+		return nil
+	case ActionUnlove:
+		// Undo every love of the story by the actor. The unlove itself is
+		// kept, but nobody is told about it.
+		ids, err := s.FindActivities(ctx, a.Actor, ActionLove, a.Story)
+		if err != nil {
+			return err
 		}
-		for _, followerID := range followers {
-			_, err = db.Query(`
-                   INSERT into notifications
-                   (id, notified_id, actor_id, action, date, story_id)
-                   VALUES ($1, $2, $3, $4, $5, $6)
-            `, uuid.NewV4(), followerID, a.Actor, a.Action, now(), story)
-			if err != nil {
+		for _, id := range ids {
+			if err := s.DeleteActivity(ctx, id); err != nil {
 				return err
 			}
 		}
-
+		logging.FromContext(ctx).Debug("Unloved story", "story", a.Story,
+			"loves", len(ids))
+		return nil
+	case ActionRead, ActionLove /* 😍 */, ActionWrite, ActionComment:
+		// Add notification to actor's followers.
+		if a.Action != ActionWrite {
+			// No spec for creating a new story, so for now we leave the
+			// story out of write notifications.
+			n.Story = a.Story
+		}
+		followers, err := s.FanOut(ctx, a, n)
+		if err != nil {
+			return err
+		}
+		fanoutSize.Observe(float64(followers))
+		logging.FromContext(ctx).Debug("Fanned out activity",
+			"action", a.Action, "followers", followers)
+		return nil
 	}
-	return err
+	return nil
 }
 
 // Save saves the activity to the database, and it also creates the
-// notification object(s).
-func (a *Activity) Save(db *sql.DB) error {
-	// First, save the activity to the database.
-	tx, _ := db.Begin()
-
-	err := saveActivity(db, a)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	err = createNotifications(db, a)
+// notification object(s) and queues the push notifications. Everything is
+// written in one transaction, so either all of it is saved or none of it.
+// Save assigns the activity its ID and date.
+func (a *Activity) Save(ctx context.Context, s Store) error {
+	a.ID = genID()
+	a.Date = now()
+	err := s.Atomic(ctx, func(tx Store) error {
+		// First, save the activity to the database.
+		err := tx.InsertActivity(ctx, a)
+		if err != nil {
+			return err
+		}
+		err = createNotifications(ctx, tx, a)
+		if err != nil {
+			return err
+		}
+		// Queue push notifications along with everything else, so that
+		// they are neither lost nor sent for an activity that didn't save.
+		return a.PushNotify(ctx, tx)
+	})
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
-	// Save as a transaction.
-	err = tx.Commit()
-	return err
+	activitiesSaved.WithLabelValues(a.Action).Inc()
+	return nil
 }
 
-// PushNotify executes a Push Notification for the given activity.
-func (a *Activity) PushNotify() error {
+// PushNotify queues the Push Notifications for the given activity. Run it
+// on the activity's transaction; the push dispatcher delivers the
+// notifications once that commits.
+func (a *Activity) PushNotify(ctx context.Context, s Store) error {
 
 	/*
 	   - user follows another user
@@ -230,23 +286,29 @@ func (a *Activity) PushNotify() error {
 	   - user comments on a story
 	       - send push notification to story’s author
 	*/
+	var msgs []push.Message
 	switch a.Action {
 	case ActionFollow:
 		// Send push notification to followed user. (a.User2)
-		actor, err := getUser(db, a.Actor)
+		actor, err := s.GetUser(ctx, a.Actor)
 		if err != nil {
 			return err
 		}
-		log.Printf("[DEBUG] Sending push notification to followed user")
-		push.Notify(a.User2, actor.name()+" started following you.")
+		logging.FromContext(ctx).Debug(
+			"Sending push notification to followed user", "user", a.User2)
+		msgs = append(msgs, push.Message{
+			UserID:     a.User2,
+			Body:       actor.name() + " started following you.",
+			ActivityID: a.ID,
+		})
 
 	case ActionRead, ActionLove, ActionComment:
 		// Send push notification to story's author
-		story, err := getStory(db, a.Story)
+		story, err := s.GetStory(ctx, a.Story)
 		if err != nil {
 			return err
 		}
-		actor, err := getUser(db, a.Actor)
+		actor, err := s.GetUser(ctx, a.Actor)
 		if err != nil {
 			return err
 		}
@@ -259,123 +321,36 @@ func (a *Activity) PushNotify() error {
 		} else if a.Action == ActionLove {
 			snippet = "loves"
 		}
-		log.Printf("[DEBUG] Sending push notification to story's author")
-		push.Notify(story.Author, actor.name()+" "+snippet+" "+story.Title)
+		logging.FromContext(ctx).Debug(
+			"Sending push notification to story's author", "user",
+			story.Author)
+		msgs = append(msgs, push.Message{
+			UserID:     story.Author,
+			Body:       actor.name() + " " + snippet + " " + story.Title,
+			ActivityID: a.ID,
+		})
 
 	case ActionWrite:
 		// Send push notification to all actor's followers.
-		followers, err := getFollowerIDs(db, a.Actor)
+		followers, err := s.GetFollowerIDs(ctx, a.Actor)
 		if err != nil {
 			return err
 		}
-		author, err := getUser(db, a.Actor)
+		author, err := s.GetUser(ctx, a.Actor)
 		if err != nil {
 			return err
 		}
-		log.Printf(
-			"[DEBUG] Sending push notification to all of the writer's %v followers",
-			len(followers))
-		push.NotifyMultiple(followers,
-			author.name()+" just wrote a cool story. Check it out!")
-	}
-	return nil
-
-}
-
-func getUser(db *sql.DB, id string) (*User, error) {
-	var firstname string
-	var lastname string
-	err := db.QueryRow(
-		"SELECT firstname, lastname FROM users WHERE sid = $1", id).Scan(
-		&firstname, &lastname)
-	if err != nil {
-		if strings.Contains(err.Error(), "no rows") {
-			return nil, errors.New("User with that ID not found.")
-		}
-		return nil, err
-	}
-	return &User{
-		FirstName: firstname,
-		LastName:  lastname,
-		ID:        id,
-	}, nil
-}
-
-func getStory(db *sql.DB, id string) (*Story, error) {
-	var title string
-	var author string
-	err := db.QueryRow(
-		"SELECT title, author_id FROM stories WHERE sid = $1", id).Scan(
-		&title, &author)
-	if err != nil {
-		if strings.Contains(err.Error(), "no rows") {
-			return nil, errors.New("Story with that ID not found.")
-		}
-		return nil, err
-	}
-	return &Story{
-		Title:  title,
-		Author: author, // This is still a User ID.
-		ID:     id,
-	}, nil
-}
-
-func getFollowerIDs(db *sql.DB, id string) ([]string, error) {
-	ids := []string{}
-	rows, err := db.Query(
-		"SELECT follower_id FROM followers WHERE user_id = $1", id)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var id string
-		err = rows.Scan(&id)
-		if err != nil {
-			return nil, err
+		logging.FromContext(ctx).Debug(
+			"Sending push notification to all of the writer's followers",
+			"followers", len(followers))
+		for _, followerID := range followers {
+			msgs = append(msgs, push.Message{
+				UserID:     followerID,
+				Body:       author.name() + " just wrote a cool story. Check it out!",
+				ActivityID: a.ID,
+			})
 		}
-		ids = append(ids, id)
 	}
-	return ids, nil
-}
+	return s.QueuePush(ctx, msgs...)
 
-func getNotifications(db *sql.DB, user *User) ([]Notification, error) {
-	notifications := []Notification{}
-	rows, err := db.Query(`
-        SELECT actor_id, story_id, action, date
-        FROM notifications
-        WHERE notified_id = $1
-        ORDER BY date
-    `, user.ID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var actorID string
-		var storyID sql.NullString
-		var action string
-		var date time.Time
-		err = rows.Scan(&actorID, &storyID, &action, &date)
-		if err != nil {
-			return nil, err
-		}
-		notification := Notification{
-			Action: action,
-			Actor:  actorID,
-			Date:   date.Format(HookedRFC),
-		}
-		if !storyID.Valid {
-			notification.Story = "" // Will be removed from struct by omitempty
-		} else {
-			notification.Story = storyID.String
-		}
-		if action == ActionFollow {
-			// The user is the followed (who would get the notification),
-			// actor is the follower
-			notification.User2 = user.ID
-		}
-		notifications = append(notifications, notification)
-	}
-	return notifications, nil
 }
@@ -0,0 +1,210 @@
+package hooked
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/domino14/cool-api/push"
+)
+
+var errInjected = errors.New("injected failure")
+
+// failingStore is a Store whose method named fail returns errInjected,
+// including inside transactions.
+type failingStore struct {
+	Store
+	fail string
+}
+
+func (f failingStore) Atomic(ctx context.Context,
+	fn func(Store) error) error {
+
+	return f.Store.Atomic(ctx, func(tx Store) error {
+		return fn(failingStore{tx, f.fail})
+	})
+}
+
+func (f failingStore) InsertActivity(ctx context.Context,
+	a *Activity) error {
+
+	if f.fail == "InsertActivity" {
+		return errInjected
+	}
+	return f.Store.InsertActivity(ctx, a)
+}
+
+func (f failingStore) AddFollower(ctx context.Context,
+	userID, followerID, since string) error {
+
+	if f.fail == "AddFollower" {
+		return errInjected
+	}
+	return f.Store.AddFollower(ctx, userID, followerID, since)
+}
+
+func (f failingStore) AddNotifications(ctx context.Context,
+	notifiedIDs []string, n Notification) error {
+
+	if f.fail == "AddNotifications" {
+		return errInjected
+	}
+	return f.Store.AddNotifications(ctx, notifiedIDs, n)
+}
+
+func (f failingStore) FanOut(ctx context.Context, a *Activity,
+	n Notification) (int, error) {
+
+	if f.fail == "FanOut" {
+		return 0, errInjected
+	}
+	return f.Store.FanOut(ctx, a, n)
+}
+
+func (f failingStore) QueuePush(ctx context.Context,
+	msgs ...push.Message) error {
+
+	if f.fail == "QueuePush" {
+		return errInjected
+	}
+	return f.Store.QueuePush(ctx, msgs...)
+}
+
+// newTestMemoryStore returns a MemoryStore where u2 follows u1, and u1
+// wrote s1.
+func newTestMemoryStore(t *testing.T, opts ...StoreOption) *MemoryStore {
+	m := NewMemoryStore(opts...)
+	m.AddUser(User{ID: "u1", FirstName: "Annie", LastName: "Odom"})
+	m.AddUser(User{ID: "u2", FirstName: "Bob", LastName: "Bell"})
+	m.AddUser(User{ID: "u3", FirstName: "Cat", LastName: "Cole"})
+	m.AddStory(Story{ID: "s1", Title: "Hooked", Author: "u1"})
+	err := m.AddFollower(context.Background(), "u1", "u2",
+		"2017-06-27T00:00:00.000Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSaveRollsBack(t *testing.T) {
+	for _, tc := range []struct {
+		fail     string
+		activity Activity
+	}{
+		{"AddNotifications", Activity{Action: ActionFollow, Actor: "u3",
+			User2: "u1"}},
+		{"AddFollower", Activity{Action: ActionFollow, Actor: "u3",
+			User2: "u1"}},
+		{"QueuePush", Activity{Action: ActionFollow, Actor: "u3",
+			User2: "u1"}},
+		{"FanOut", Activity{Action: ActionLove, Actor: "u1", Story: "s1"}},
+		{"QueuePush", Activity{Action: ActionLove, Actor: "u1",
+			Story: "s1"}},
+		{"QueuePush", Activity{Action: ActionWrite, Actor: "u1"}},
+	} {
+		t.Run(tc.activity.Action+"/"+tc.fail, func(t *testing.T) {
+			m := newTestMemoryStore(t)
+			a := tc.activity
+			err := a.Save(context.Background(), failingStore{m, tc.fail})
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("Save returned %v, want the injected failure", err)
+			}
+			if n := len(m.Activities()); n != 0 {
+				t.Errorf("%d activities saved, want none", n)
+			}
+			if n := len(m.st.notifications); n != 0 {
+				t.Errorf("%d notifications saved, want none", n)
+			}
+			if n := len(m.st.pushes); n != 0 {
+				t.Errorf("%d pushes queued, want none", n)
+			}
+			if _, ok := m.st.followers["u1"]["u3"]; ok {
+				t.Error("follower saved")
+			}
+			if _, ok := m.st.followers["u1"]["u2"]; !ok {
+				t.Error("existing follower lost")
+			}
+		})
+	}
+}
+
+func TestSaveWritesEverything(t *testing.T) {
+	m := newTestMemoryStore(t)
+	a := Activity{Action: ActionLove, Actor: "u1", Story: "s1"}
+	if err := a.Save(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m.Activities()); n != 1 {
+		t.Errorf("%d activities saved, want 1", n)
+	}
+	// u2 follows u1, and the author gets a push.
+	if n := len(m.st.notifications); n != 1 {
+		t.Errorf("%d notifications saved, want 1", n)
+	}
+	if n := len(m.st.pushes); n != 1 {
+		t.Errorf("%d pushes queued, want 1", n)
+	}
+}
+
+func TestUnfollowKeepsNotifications(t *testing.T) {
+	// Fan-out on write at threshold 0, and on read at 1, since u1 has two
+	// followers. The feeds should look the same.
+	for _, threshold := range []int{0, 1} {
+		ctx := context.Background()
+		m := newTestMemoryStore(t, WithFanoutOnRead(threshold))
+		err := m.AddFollower(ctx, "u1", "u3", "2017-06-27T00:00:00.000Z")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := &User{ID: "u2"}
+		save := func(a Activity) {
+			if err := a.Save(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		save(Activity{Action: ActionLove, Actor: "u1", Story: "s1"})
+		page, err := m.GetNotifications(ctx, user, NotificationQuery{Limit: 10})
+		if err != nil || len(page.Notifications) != 1 {
+			t.Fatalf("threshold %d: got %v, %v; want one notification",
+				threshold, page, err)
+		}
+		_, err = m.MarkRead(ctx, user, []string{page.Notifications[0].ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		save(Activity{Action: ActionUnfollow, Actor: "u2", User2: "u1"})
+		save(Activity{Action: ActionLove, Actor: "u1", Story: "s1"})
+
+		page, err = m.GetNotifications(ctx, user, NotificationQuery{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Notifications) != 1 {
+			t.Fatalf("threshold %d: %d notifications after unfollowing, "+
+				"want the one from before", threshold, len(page.Notifications))
+		}
+		if n := page.Notifications[0]; n.Action != ActionLove ||
+			n.ReadAt == "" {
+			t.Errorf("threshold %d: got %+v, want the read love", threshold, n)
+		}
+	}
+}
+
+func TestDeleteActivityCancelsPushes(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMemoryStore(t)
+	kept := Activity{Action: ActionRead, Actor: "u3", Story: "s1"}
+	deleted := Activity{Action: ActionLove, Actor: "u2", Story: "s1"}
+	for _, a := range []*Activity{&kept, &deleted} {
+		if err := a.Save(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.DeleteActivity(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	pushes := m.Pushes()
+	if len(pushes) != 1 || pushes[0].ActivityID != kept.ID {
+		t.Errorf("got pushes %+v, want just the one for %s", pushes, kept.ID)
+	}
+}
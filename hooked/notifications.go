@@ -0,0 +1,272 @@
+package hooked
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The page size limits a Server uses unless told otherwise with
+// WithPageLimits.
+const (
+	DefaultNotificationLimit = 50
+	MaxNotificationLimit     = 200
+)
+
+// A Cursor marks a position in a user's notifications feed. The feed is
+// ordered by date, with ties broken by notification ID.
+type Cursor struct {
+	Date time.Time
+	ID   string
+}
+
+// String encodes the cursor. Clients should treat the result as opaque.
+func (c Cursor) String() string {
+	raw := c.Date.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// before reports whether c sorts before the notification at (date, id).
+func (c Cursor) before(date time.Time, id string) bool {
+	return c.Date.Before(date) || (c.Date.Equal(date) && c.ID < id)
+}
+
+// after reports whether c sorts after the notification at (date, id).
+func (c Cursor) after(date time.Time, id string) bool {
+	return c.Date.After(date) || (c.Date.Equal(date) && c.ID > id)
+}
+
+// ParseCursor decodes a cursor made by Cursor.String.
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("Bad cursor.")
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errors.New("Bad cursor.")
+	}
+	date, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, errors.New("Bad cursor.")
+	}
+	return &Cursor{Date: date, ID: parts[1]}, nil
+}
+
+// NotificationQuery selects a page of a user's notifications. The zero
+// value, with a Limit, gets the newest notifications.
+type NotificationQuery struct {
+	Limit int
+	// Ascending lists the oldest notifications first.
+	Ascending bool
+	// Before and After are exclusive bounds.
+	Before *Cursor
+	After  *Cursor
+
+	Action string
+	Actor  string
+	Story  string
+	Unread bool
+	// Since is inclusive, Until is exclusive.
+	Since time.Time
+	Until time.Time
+}
+
+// NotificationPage is one page of a notifications feed. To get the next
+// page, pass NextCursor as `before` (or as `after`, when listing oldest
+// first). It's empty on the last page.
+type NotificationPage struct {
+	Notifications []Notification `json:"notifications"`
+	NextCursor    string         `json:"next_cursor,omitempty"`
+}
+
+// newNotificationPage makes a page out of up to limit+1 notifications,
+// fetched in order. The extra one tells us whether there's a next page.
+func newNotificationPage(ns []Notification, limit int) *NotificationPage {
+	page := &NotificationPage{Notifications: ns}
+	if len(ns) > limit {
+		page.Notifications = ns[:limit]
+		last := ns[limit-1]
+		page.NextCursor = Cursor{Date: last.at, ID: last.ID}.String()
+	}
+	return page
+}
+
+// parseNotificationQuery reads a NotificationQuery from URL parameters. The
+// limit is defaultLimit if none is given, and at most maxLimit.
+func parseNotificationQuery(v url.Values, defaultLimit,
+	maxLimit int) (NotificationQuery, error) {
+
+	q := NotificationQuery{
+		Limit:  defaultLimit,
+		Action: v.Get("action"),
+		Actor:  v.Get("actor"),
+		Story:  v.Get("story"),
+	}
+	var err error
+	if u := v.Get("unread"); u != "" {
+		if q.Unread, err = strconv.ParseBool(u); err != nil {
+			return q, errors.New("unread must be true or false")
+		}
+	}
+	if l := v.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit < 1 || q.Limit > maxLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+	}
+	switch v.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+	if c := v.Get("before"); c != "" {
+		if q.Before, err = ParseCursor(c); err != nil {
+			return q, err
+		}
+	}
+	if c := v.Get("after"); c != "" {
+		if q.After, err = ParseCursor(c); err != nil {
+			return q, err
+		}
+	}
+	if t := v.Get("since"); t != "" {
+		if q.Since, err = time.Parse(time.RFC3339, t); err != nil {
+			return q, errors.New("since must be an RFC 3339 date")
+		}
+	}
+	if t := v.Get("until"); t != "" {
+		if q.Until, err = time.Parse(time.RFC3339, t); err != nil {
+			return q, errors.New("until must be an RFC 3339 date")
+		}
+	}
+	return q, nil
+}
+
+// MarkReadRequest is the body of a mark-as-read request. Either list the
+// notification IDs, or pass a cursor as UpTo to mark it and everything
+// before it as read.
+type MarkReadRequest struct {
+	IDs  []string `json:"ids"`
+	UpTo string   `json:"up_to"`
+}
+
+const (
+	DefaultGroupWindow = 24 * time.Hour
+	// GroupActorIDs is how many actor IDs a group lists.
+	GroupActorIDs = 3
+)
+
+// A NotificationGroup collapses similar notifications, for "Annie and 4
+// others loved your story". Notifications are similar if they have the
+// same action and story (follows just need the same action). A group never
+// spans more than the grouping window.
+type NotificationGroup struct {
+	Action string `json:"action"`
+	Story  string `json:"story,omitempty"`
+	User2  string `json:"user2,omitempty"`
+	// Actors has the first few actor IDs, most recent first.
+	Actors     []string `json:"actors"`
+	ActorCount int      `json:"actor_count"`
+	// IDs has every notification in the group, e.g. to mark them as read.
+	IDs    []string `json:"ids"`
+	Unread int      `json:"unread"`
+	// Date is when the newest notification in the group happened, and
+	// Since when the oldest one did.
+	Date  string `json:"date"`
+	Since string `json:"since"`
+
+	latest   time.Time
+	earliest time.Time
+	actors   map[string]bool
+}
+
+// GroupedNotificationPage is a NotificationPage, grouped. Groups don't
+// span pages, so a group may continue on the next page.
+type GroupedNotificationPage struct {
+	Groups     []*NotificationGroup `json:"groups"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// groupNotifications groups notifications that come in feed order, either
+// newest or oldest first. Groups come out in the same order.
+func groupNotifications(ns []Notification,
+	window time.Duration) []*NotificationGroup {
+
+	groups := []*NotificationGroup{}
+	open := map[string]*NotificationGroup{}
+	for _, n := range ns {
+		key := n.Action + "|" + n.Story
+		g := open[key]
+		if g != nil && (n.at.Sub(g.earliest) > window ||
+			g.latest.Sub(n.at) > window) {
+			g = nil
+		}
+		if g == nil {
+			g = &NotificationGroup{
+				Action:   n.Action,
+				Story:    n.Story,
+				User2:    n.User2,
+				Actors:   []string{},
+				latest:   n.at,
+				earliest: n.at,
+				actors:   map[string]bool{},
+			}
+			open[key] = g
+			groups = append(groups, g)
+		}
+		g.IDs = append(g.IDs, n.ID)
+		if n.ReadAt == "" {
+			g.Unread++
+		}
+		if n.at.After(g.latest) {
+			g.latest = n.at
+		}
+		if n.at.Before(g.earliest) {
+			g.earliest = n.at
+		}
+		if !g.actors[n.Actor] {
+			g.actors[n.Actor] = true
+			g.ActorCount++
+			g.Actors = append(g.Actors, n.Actor)
+		}
+	}
+	for _, g := range groups {
+		if len(g.Actors) > GroupActorIDs {
+			g.Actors = g.Actors[:GroupActorIDs]
+		}
+		g.Date = g.latest.Format(HookedRFC)
+		g.Since = g.earliest.Format(HookedRFC)
+	}
+	return groups
+}
+
+// parseGroupWindow reads the grouping window from URL parameters. A zero
+// window means don't group.
+func parseGroupWindow(v url.Values) (time.Duration, error) {
+	group, err := strconv.ParseBool(v.Get("group"))
+	if v.Get("group") == "" || (err == nil && !group) {
+		if v.Get("window") != "" {
+			return 0, errors.New("window only makes sense with group=true")
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.New("group must be true or false")
+	}
+	w := v.Get("window")
+	if w == "" {
+		return DefaultGroupWindow, nil
+	}
+	window, err := time.ParseDuration(w)
+	if err != nil || window <= 0 {
+		return 0, errors.New("window must be a positive duration, like 6h")
+	}
+	return window, nil
+}
@@ -0,0 +1,422 @@
+package hooked
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// addTestNotifications gives u2 a love notification from u1 at each date.
+func addTestNotifications(t *testing.T, m *MemoryStore, dates ...string) {
+	for _, date := range dates {
+		err := m.AddNotifications(context.Background(), []string{"u2"},
+			Notification{Action: ActionLove, Actor: "u1", Story: "s1",
+				Date: date})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// allPages follows the feed's cursors a page of limit at a time, and
+// returns the IDs in the order they came.
+func allPages(t *testing.T, m *MemoryStore, limit int, asc bool) []string {
+	var ids []string
+	q := NotificationQuery{Limit: limit, Ascending: asc}
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("the cursors go round in circles")
+		}
+		page, err := m.GetNotifications(context.Background(), &User{ID: "u2"},
+			q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range page.Notifications {
+			ids = append(ids, n.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		c, err := ParseCursor(page.NextCursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if asc {
+			q.After = c
+		} else {
+			q.Before = c
+		}
+	}
+}
+
+func TestPaginationTies(t *testing.T) {
+	m := newTestMemoryStore(t)
+	// Five notifications at the same time, so that pages of two split the
+	// tie.
+	addTestNotifications(t, m, "2017-06-27T00:00:00.000Z")
+	addTestNotifications(t, m, "2017-06-28T00:00:00.000Z",
+		"2017-06-28T00:00:00.000Z", "2017-06-28T00:00:00.000Z",
+		"2017-06-28T00:00:00.000Z", "2017-06-28T00:00:00.000Z")
+	addTestNotifications(t, m, "2017-06-29T00:00:00.000Z")
+
+	all := allPages(t, m, 100, false)
+	if len(all) != 7 {
+		t.Fatalf("got %d notifications, want 7", len(all))
+	}
+	for _, limit := range []int{1, 2, 3} {
+		got := allPages(t, m, limit, false)
+		if len(got) != len(all) {
+			t.Fatalf("limit %d: got %v, want %v", limit, got, all)
+		}
+		for i := range got {
+			if got[i] != all[i] {
+				t.Fatalf("limit %d: got %v, want %v", limit, got, all)
+			}
+		}
+		asc := allPages(t, m, limit, true)
+		if len(asc) != len(all) {
+			t.Fatalf("limit %d, ascending: got %v, want %v", limit, asc,
+				all)
+		}
+		for i := range asc {
+			if asc[i] != all[len(all)-1-i] {
+				t.Fatalf("limit %d, ascending: got %v, want %v reversed",
+					limit, asc, all)
+			}
+		}
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	c := Cursor{ID: "abc"}
+	c.Date = c.Date.Add(1234)
+	got, err := ParseCursor(c.String())
+	if err != nil || !got.Date.Equal(c.Date) || got.ID != c.ID {
+		t.Errorf("ParseCursor(%s) = %v, %v; want %v", c, got, err, c)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	for _, s := range []string{
+		"", "not base64!", enc([]byte("no bar")),
+		enc([]byte("2017-06-27T00:00:00Z|")),
+		enc([]byte("yesterday|abc")),
+	} {
+		if c, err := ParseCursor(s); err == nil {
+			t.Errorf("ParseCursor(%q) = %v, want an error", s, c)
+		}
+	}
+}
+
+func TestParseNotificationQueryLimit(t *testing.T) {
+	for _, tc := range []struct {
+		limit string
+		want  int
+		ok    bool
+	}{
+		{"", 50, true},
+		{"1", 1, true},
+		{"200", 200, true},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"201", 0, false},
+		{"ten", 0, false},
+	} {
+		v := url.Values{}
+		if tc.limit != "" {
+			v.Set("limit", tc.limit)
+		}
+		q, err := parseNotificationQuery(v, DefaultNotificationLimit,
+			MaxNotificationLimit)
+		if (err == nil) != tc.ok {
+			t.Errorf("limit %q: got error %v, want ok = %v", tc.limit, err,
+				tc.ok)
+			continue
+		}
+		if tc.ok && q.Limit != tc.want {
+			t.Errorf("limit %q: got %d, want %d", tc.limit, q.Limit, tc.want)
+		}
+	}
+	for _, p := range []string{"before", "after"} {
+		_, err := parseNotificationQuery(url.Values{p: {"nope"}},
+			DefaultNotificationLimit, MaxNotificationLimit)
+		if err == nil {
+			t.Errorf("a bad %s cursor was accepted", p)
+		}
+	}
+}
+
+func TestReadState(t *testing.T) {
+	ctx := context.Background()
+	// u1 has two followers, so their activities are merged into feeds.
+	m := newTestMemoryStore(t, WithFanoutOnRead(1))
+	err := m.AddFollower(ctx, "u1", "u3", "2017-06-27T00:00:00.000Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestNotifications(t, m, "2017-06-27T00:00:00.000Z",
+		"2017-06-28T00:00:00.000Z")
+	for _, a := range []Activity{
+		{Action: ActionLove, Actor: "u1", Story: "s1"},
+		{Action: ActionWrite, Actor: "u1"},
+	} {
+		if err := a.Save(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u2, u3 := &User{ID: "u2"}, &User{ID: "u3"}
+	unread := func(u *User, want int) {
+		t.Helper()
+		n, err := m.CountUnread(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s has %d unread, want %d", u.ID, n, want)
+		}
+	}
+	mark := func(u *User, ids []string, want int) {
+		t.Helper()
+		n, err := m.MarkRead(ctx, u, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("marked %d of %v read for %s, want %d", n, ids, u.ID,
+				want)
+		}
+	}
+
+	unread(u2, 4)
+	page, err := m.GetNotifications(ctx, u2, NotificationQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Newest first: the two merged ones, then the two written ones.
+	ns := page.Notifications
+	if len(ns) != 4 {
+		t.Fatalf("got %d notifications, want 4", len(ns))
+	}
+	merged, written := ns[1], ns[2]
+	mark(u2, []string{merged.ID, written.ID}, 2)
+	mark(u2, []string{merged.ID, written.ID}, 0)
+	unread(u2, 2)
+	// Merged notifications are read separately by each follower, and have
+	// different IDs in each feed.
+	unread(u3, 2)
+	mark(u3, []string{merged.ID}, 0)
+	page, err = m.GetNotifications(ctx, u3, NotificationQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Notifications) != 2 {
+		t.Fatalf("u3 got %d notifications, want 2", len(page.Notifications))
+	}
+	mark(u3, []string{page.Notifications[1].ID}, 1)
+	unread(u3, 1)
+	unread(u2, 2)
+	// Somebody else's notification can't be marked.
+	mark(u3, []string{written.ID}, 0)
+
+	// Up to the merged one: that leaves the oldest to mark.
+	n, err := m.MarkReadUpTo(ctx, u2, Cursor{Date: merged.at, ID: merged.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("marked %d up to %s, want 1", n, merged.ID)
+	}
+	unread(u2, 1)
+
+	page, err = m.GetNotifications(ctx, u2,
+		NotificationQuery{Limit: 10, Unread: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Notifications) != 1 || page.Notifications[0].ID != ns[0].ID {
+		t.Errorf("unread: got %+v, want just %s", page.Notifications,
+			ns[0].ID)
+	}
+	page, err = m.GetNotifications(ctx, u2, NotificationQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range page.Notifications[1:] {
+		if n.ReadAt == "" {
+			t.Errorf("%s isn't read", n.ID)
+		}
+	}
+}
+
+func TestFanoutOnReadFeed(t *testing.T) {
+	ctx := context.Background()
+	// The same activities, fanned out on write and on read, make the same
+	// feed.
+	stores := []*MemoryStore{newTestMemoryStore(t),
+		newTestMemoryStore(t, WithFanoutOnRead(1))}
+	for _, m := range stores {
+		err := m.AddFollower(ctx, "u1", "u3", "2017-06-27T00:00:00.000Z")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []Activity{
+		{Action: ActionLove, Actor: "u1", Story: "s1"},
+		{Action: ActionWrite, Actor: "u1"},
+		{Action: ActionComment, Actor: "u1", Story: "s1"},
+	} {
+		for _, m := range stores {
+			a := a
+			if err := a.Save(ctx, m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Keep the activities' dates apart, so the feeds' order is fixed.
+		time.Sleep(2 * time.Millisecond)
+	}
+	var feeds [2][]Notification
+	for i, m := range stores {
+		page, err := m.GetNotifications(ctx, &User{ID: "u2"},
+			NotificationQuery{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		feeds[i] = page.Notifications
+	}
+	if len(feeds[0]) != 3 || len(feeds[1]) != len(feeds[0]) {
+		t.Fatalf("got %d and %d notifications, want 3 of each",
+			len(feeds[0]), len(feeds[1]))
+	}
+	for i, n := range feeds[1] {
+		if _, err := uuid.FromString(n.ID); err != nil {
+			t.Errorf("merged notification ID %q isn't a UUID", n.ID)
+		}
+		w := feeds[0][i]
+		if n.Action != w.Action || n.Actor != w.Actor || n.Story != w.Story ||
+			n.ReadAt != w.ReadAt {
+			t.Errorf("notification %d: got %+v, want %+v", i, n, w)
+		}
+	}
+
+	// Merged IDs stay the same from one read to the next.
+	page, err := stores[1].GetNotifications(ctx, &User{ID: "u2"},
+		NotificationQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range page.Notifications {
+		if n.ID != feeds[1][i].ID {
+			t.Errorf("notification %d's ID went from %s to %s", i,
+				feeds[1][i].ID, n.ID)
+		}
+	}
+}
+
+func TestGroupNotifications(t *testing.T) {
+	t0 := time.Date(2017, 6, 27, 12, 0, 0, 0, time.UTC)
+	n := func(id, action, story, actor string, ago time.Duration,
+		read bool) Notification {
+
+		n := Notification{ID: id, Action: action, Story: story, Actor: actor,
+			at: t0.Add(-ago)}
+		if read {
+			n.ReadAt = t0.Format(HookedRFC)
+		}
+		return n
+	}
+	day := 24 * time.Hour
+	groups := groupNotifications([]Notification{
+		n("1", ActionLove, "s1", "a", 0, false),
+		n("2", ActionLove, "s1", "b", time.Hour, true),
+		n("3", ActionLove, "s2", "a", time.Hour, false),
+		n("4", ActionComment, "s1", "a", 2*time.Hour, false),
+		// Exactly a window from the newest love of s1 is still in its
+		// group; any further starts a new one.
+		n("5", ActionLove, "s1", "a", day, false),
+		n("6", ActionLove, "s1", "c", day+time.Nanosecond, false),
+	}, day)
+
+	want := []struct {
+		key    string
+		ids    string
+		actors string
+		unread int
+	}{
+		{"love|s1", "1,2,5", "a,b", 2},
+		{"love|s2", "3", "a", 1},
+		{"comment|s1", "4", "a", 1},
+		{"love|s1", "6", "c", 1},
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(groups), len(want))
+	}
+	for i, w := range want {
+		g := groups[i]
+		got := struct {
+			key    string
+			ids    string
+			actors string
+			unread int
+		}{g.Action + "|" + g.Story, strings.Join(g.IDs, ","),
+			strings.Join(g.Actors, ","), g.Unread}
+		if got != w {
+			t.Errorf("group %d: got %+v, want %+v", i, got, w)
+		}
+		if g.ActorCount != len(g.Actors) {
+			t.Errorf("group %d: %d actors, but ActorCount %d", i,
+				len(g.Actors), g.ActorCount)
+		}
+	}
+	if g := groups[0]; g.Date != t0.Format(HookedRFC) ||
+		g.Since != t0.Add(-day).Format(HookedRFC) {
+		t.Errorf("group 0 runs from %s to %s, want %s to %s", g.Since, g.Date,
+			t0.Add(-day).Format(HookedRFC), t0.Format(HookedRFC))
+	}
+
+	// Only the first few actors are listed, but all are counted.
+	var ns []Notification
+	for i := 0; i < GroupActorIDs+2; i++ {
+		ns = append(ns, n(strconv.Itoa(i), ActionRead, "s1",
+			"u"+strconv.Itoa(i), time.Duration(i)*time.Minute, false))
+	}
+	groups = groupNotifications(ns, day)
+	if len(groups) != 1 || len(groups[0].Actors) != GroupActorIDs ||
+		groups[0].ActorCount != GroupActorIDs+2 {
+		t.Errorf("got %+v, want one group listing %d of %d actors",
+			groups, GroupActorIDs, GroupActorIDs+2)
+	}
+}
+
+func TestParseGroupWindow(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, true},
+		{"group=false", 0, true},
+		{"group=true", DefaultGroupWindow, true},
+		{"group=1&window=6h", 6 * time.Hour, true},
+		{"window=6h", 0, false},
+		{"group=false&window=6h", 0, false},
+		{"group=maybe", 0, false},
+		{"group=true&window=0s", 0, false},
+		{"group=true&window=-1h", 0, false},
+		{"group=true&window=a+day", 0, false},
+	} {
+		v, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseGroupWindow(v)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%q: got %v, %v; want %v, ok = %v", tc.query, got, err,
+				tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package hooked
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/domino14/cool-api/logging"
+)
+
+// A Limit allows Count requests per Per, in bursts of up to Count. The zero
+// Limit allows everything.
+type Limit struct {
+	Count int
+	Per   time.Duration
+}
+
+// PerMinute returns a Limit of n requests a minute.
+func PerMinute(n int) Limit {
+	return Limit{n, time.Minute}
+}
+
+func (l Limit) unlimited() bool {
+	return l.Count <= 0 || l.Per <= 0
+}
+
+// rate is how many tokens a second a bucket with this limit gets back.
+func (l Limit) rate() float64 {
+	return float64(l.Count) / l.Per.Seconds()
+}
+
+// RateLimits are the limits on posting activities.
+type RateLimits struct {
+	// IP limits all the activities posted from each address.
+	IP Limit
+	// Actions limits each actor's activities of each action. Actions that
+	// aren't here are unlimited.
+	Actions map[string]Limit
+	// TrustedProxies are the load balancers and proxies in front of the
+	// API. Requests from them are limited by the address in their
+	// X-Forwarded-For header instead.
+	TrustedProxies []*net.IPNet
+}
+
+// A RateLimiter keeps a token bucket for each key.
+type RateLimiter interface {
+	// Take takes a token from the key's bucket, which has the limit l. If
+	// the bucket is empty, it returns how long until it won't be.
+	Take(ctx context.Context, key string, l Limit) (time.Duration, error)
+}
+
+// A bucket is a token bucket. It starts full, with l.Count tokens.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills b for the time since it was last updated, and then takes a
+// token if there is one. If not, it returns how long until there will be.
+func (b *bucket) take(l Limit, now time.Time) time.Duration {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(l.Count), b.tokens+elapsed*l.rate())
+	}
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate() * float64(time.Second))
+}
+
+// fullAt returns when b will be full again, after which it's the same as
+// a new bucket and needn't be kept.
+func (b *bucket) fullAt(l Limit) time.Time {
+	missing := float64(l.Count) - b.tokens
+	return b.updated.Add(time.Duration(missing / l.rate() * float64(time.Second)))
+}
+
+// sweepInterval is how often the limiters delete their full buckets.
+const sweepInterval = time.Minute
+
+// trusted reports whether addr is one of our proxies.
+func (l RateLimits) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range l.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the request came from. If it came through
+// our proxies, that's the last address in X-Forwarded-For that isn't one
+// of theirs; the ones before it could be made up by the client.
+func (l RateLimits) clientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !l.trusted(addr) {
+		return addr
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		addr = hop
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// A limitCheck is one limit that a request counts against. scope labels
+// the rate-limited metric.
+type limitCheck struct {
+	scope, key string
+	limit      Limit
+}
+
+// rateLimit limits the activities posted from each IP address, and by
+// each actor, answering 429 with a Retry-After header once a limit is
+// reached.
+func (s *Server) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	if s.limiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.isReplay(r) {
+			next(w, r)
+			return
+		}
+		logger := logging.FromContext(r.Context())
+		// The action and actor are in the body, so read it here and put it
+		// back for the handler.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Info("read-body", "err", err)
+			sendError(w, http.StatusBadRequest, CodeBadRequest,
+				"Couldn't read the body.")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		// A bad body is left for the handler to turn away.
+		var a struct{ Action, Actor string }
+		json.Unmarshal(body, &a)
+		if k, ok := APIKeyFromContext(r.Context()); ok && !k.Admin {
+			// Count against the key's user rather than whoever the body
+			// names, so that nobody can use up someone else's limit.
+			a.Actor = k.UserID
+		}
+
+		checks := []limitCheck{{"ip", "ip:" + s.limits.clientIP(r), s.limits.IP}}
+		if a.Actor != "" {
+			checks = append(checks, limitCheck{"actor",
+				"actor:" + a.Actor + ":" + a.Action, s.limits.Actions[a.Action]})
+		}
+		for _, c := range checks {
+			if c.limit.unlimited() {
+				continue
+			}
+			wait, err := s.limiter.Take(r.Context(), c.key, c.limit)
+			if err != nil {
+				// Better to let a few too many through than to turn
+				// everyone away.
+				logger.Error("rate-limit", "key", c.key, "err", err)
+				continue
+			}
+			if wait > 0 {
+				logger.Info("rate-limited", "key", c.key, "retry_after", wait)
+				rateLimited.WithLabelValues(c.scope).Inc()
+				w.Header().Set("Retry-After",
+					strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				sendError(w, http.StatusTooManyRequests, CodeRateLimited,
+					"Too many requests; try again later.")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
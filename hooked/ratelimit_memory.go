@@ -0,0 +1,49 @@
+package hooked
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memBucket
+	swept   time.Time
+}
+
+type memBucket struct {
+	bucket
+	full time.Time
+}
+
+// NewMemoryLimiter returns a RateLimiter that keeps its buckets in memory.
+// Each API instance then has its own limits; use NewPostgresLimiter to
+// share them.
+func NewMemoryLimiter() RateLimiter {
+	return &memLimiter{buckets: map[string]*memBucket{}, swept: time.Now()}
+}
+
+func (m *memLimiter) Take(ctx context.Context, key string, l Limit) (
+	time.Duration, error) {
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.swept) >= sweepInterval {
+		for k, b := range m.buckets {
+			if b.full.Before(now) {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memBucket{bucket: bucket{float64(l.Count), now}}
+		m.buckets[key] = b
+	}
+	wait := b.take(l, now)
+	b.full = b.fullAt(l)
+	return wait, nil
+}
@@ -0,0 +1,73 @@
+package hooked
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/domino14/cool-api/logging"
+)
+
+type pgLimiter struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// NewPostgresLimiter returns a RateLimiter that keeps its buckets in the
+// rate_limits table, so that every API instance shares them.
+func NewPostgresLimiter(db *sql.DB) RateLimiter {
+	return &pgLimiter{db: db, swept: time.Now()}
+}
+
+func (p *pgLimiter) Take(ctx context.Context, key string, l Limit) (
+	time.Duration, error) {
+
+	defer p.sweep(ctx)
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// This creates the bucket, full, if there isn't one, and either way
+	// locks it until we're done. The database's clock is used rather than
+	// ours, so that every instance agrees.
+	var b bucket
+	var now time.Time
+	err = tx.QueryRowContext(ctx, `
+        INSERT INTO rate_limits (key, tokens, updated_at, full_at)
+        VALUES ($1, $2, now(), now())
+        ON CONFLICT (key) DO UPDATE SET key = EXCLUDED.key
+        RETURNING tokens, updated_at, now()
+    `, key, l.Count).Scan(&b.tokens, &b.updated, &now)
+	if err != nil {
+		return 0, err
+	}
+	wait := b.take(l, now)
+	_, err = tx.ExecContext(ctx, `
+        UPDATE rate_limits SET tokens = $2, updated_at = $3, full_at = $4
+        WHERE key = $1
+    `, key, b.tokens, b.updated, b.fullAt(l))
+	if err != nil {
+		return 0, err
+	}
+	return wait, tx.Commit()
+}
+
+// sweep deletes the buckets that are full again, at most once every
+// sweepInterval.
+func (p *pgLimiter) sweep(ctx context.Context) {
+	p.mu.Lock()
+	if time.Since(p.swept) < sweepInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.swept = time.Now()
+	p.mu.Unlock()
+	_, err := p.db.ExecContext(ctx,
+		`DELETE FROM rate_limits WHERE full_at < now()`)
+	if err != nil {
+		logging.FromContext(ctx).Error("sweep-rate-limits", "err", err)
+	}
+}
@@ -0,0 +1,82 @@
+package hooked
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	l := RateLimits{TrustedProxies: []*net.IPNet{lb}}
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		// Only trusted proxies may say who the client is.
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"10.0.0.5:1234", "198.51.100.7", "198.51.100.7"},
+		// The client can put anything first; the last untrusted hop is
+		// the one our proxy saw.
+		{"10.0.0.5:1234", "1.2.3.4, 198.51.100.7, 10.0.0.6", "198.51.100.7"},
+		{"10.0.0.5:1234", "", "10.0.0.5"},
+	} {
+		r := httptest.NewRequest("POST", "/activity", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := l.clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tc.remote, tc.xff,
+				got, tc.want)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	l := Limit{2, time.Second}
+	start := time.Now()
+	b := bucket{float64(l.Count), start}
+	for i, want := range []time.Duration{0, 0, 500 * time.Millisecond} {
+		if got := b.take(l, start); got != want {
+			t.Errorf("take %d: wait %v, want %v", i, got, want)
+		}
+	}
+	if got := b.take(l, start.Add(500*time.Millisecond)); got != 0 {
+		t.Errorf("after refilling: wait %v, want 0", got)
+	}
+}
+
+func TestReplaysArentLimited(t *testing.T) {
+	s, err := NewServer(WithStore(newTestMemoryStore(t)), WithAuth(false),
+		WithRateLimit(NewMemoryLimiter(), RateLimits{IP: Limit{1, time.Hour}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+	post := func(key string) int {
+		r := httptest.NewRequest("POST", "/activity", strings.NewReader(
+			`{"action":"love","actor":"u2","story":"s1"}`))
+		r.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	for i, tc := range []struct {
+		key  string
+		want int
+	}{
+		{"a", http.StatusOK},
+		{"a", http.StatusOK},
+		{"a", http.StatusOK},
+		{"b", http.StatusTooManyRequests},
+	} {
+		if got := post(tc.key); got != tc.want {
+			t.Errorf("post %d with key %s: status %d, want %d", i, tc.key,
+				got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package hooked
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/domino14/cool-api/logging"
+)
+
+// RequestIDHeader carries each request's ID. A client may set it to tie
+// its own logs to ours; otherwise the server makes one up. Either way it
+// is echoed in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID reports whether a client-supplied request ID is safe to
+// put in our logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware gives each request an ID, and a logger that includes
+// it in every line. Both go in the request's context, so the model and
+// push code log with them too. It also logs each request as it finishes.
+func (s *Server) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = genID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		logger := s.logger.With("request_id", id)
+		ctx := logging.NewContext(logging.WithRequestID(r.Context(), id),
+			logger)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		logger.Info("request", "method", r.Method, "path", r.URL.Path,
+			"status", rec.code, "duration", time.Since(start))
+	})
+}
@@ -0,0 +1,273 @@
+package hooked
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/domino14/cool-api/push"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server is the API server. Build one with NewServer.
+type Server struct {
+	addr       string
+	store      Store
+	dispatcher *push.Dispatcher
+	logger     *slog.Logger
+
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
+
+	defaultLimit int
+	maxLimit     int
+
+	checks []namedCheck
+	build  BuildInfo
+	auth   bool
+
+	limiter RateLimiter
+	limits  RateLimits
+
+	idempotencyTTL time.Duration
+	// swept is when expired idempotency keys were last deleted.
+	sweepMu sync.Mutex
+	swept   time.Time
+
+	handler    http.Handler
+	httpServer *http.Server
+}
+
+// An Option configures a Server.
+type Option func(*Server)
+
+// WithAddr sets the address to listen on, e.g. ":8086".
+func WithAddr(addr string) Option {
+	return func(s *Server) { s.addr = addr }
+}
+
+// WithStore sets where the server keeps its data. It is required.
+func WithStore(store Store) Option {
+	return func(s *Server) { s.store = store }
+}
+
+// WithPush sets the dispatcher that delivers queued push notifications.
+// The server starts it in Run and drains it on shutdown. Without one,
+// notifications are queued but the server won't deliver them, and the
+// push admin endpoints are left out.
+func WithPush(d *push.Dispatcher) Option {
+	return func(s *Server) { s.dispatcher = d }
+}
+
+// WithLogger sets the logger. Each request logs through it with the
+// request's ID attached. The default is slog's default logger.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) { s.logger = l }
+}
+
+// WithTimeouts sets the HTTP server's read, write and idle timeouts.
+func WithTimeouts(read, write, idle time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = read
+		s.writeTimeout = write
+		s.idleTimeout = idle
+	}
+}
+
+// WithShutdownTimeout sets how long a shutdown waits for in-flight
+// requests and push deliveries.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) { s.shutdownTimeout = d }
+}
+
+// WithAuth turns API key authentication on or off. It's on by default;
+// with it off, anyone can do anything, so only turn it off for local
+// experiments.
+func WithAuth(enabled bool) Option {
+	return func(s *Server) { s.auth = enabled }
+}
+
+// WithRateLimit limits how fast activities may be posted, keeping track
+// in l. Without it, they aren't limited at all.
+func WithRateLimit(l RateLimiter, limits RateLimits) Option {
+	return func(s *Server) {
+		s.limiter = l
+		s.limits = limits
+	}
+}
+
+// WithIdempotencyTTL sets how long idempotency keys are kept, and so how
+// long a client has to retry a request.
+func WithIdempotencyTTL(d time.Duration) Option {
+	return func(s *Server) { s.idempotencyTTL = d }
+}
+
+// WithPageLimits sets how many notifications a page has when the client
+// doesn't say, and the most a client may ask for.
+func WithPageLimits(defaultLimit, maxLimit int) Option {
+	return func(s *Server) {
+		s.defaultLimit = defaultLimit
+		s.maxLimit = maxLimit
+	}
+}
+
+// NewServer builds a Server from the given options.
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		addr:            ":8086",
+		logger:          slog.Default(),
+		readTimeout:     10 * time.Second,
+		writeTimeout:    30 * time.Second,
+		idleTimeout:     2 * time.Minute,
+		shutdownTimeout: 30 * time.Second,
+		defaultLimit:    DefaultNotificationLimit,
+		maxLimit:        MaxNotificationLimit,
+		auth:            true,
+		idempotencyTTL:  DefaultIdempotencyTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.store == nil {
+		return nil, errors.New("hooked: NewServer needs a store")
+	}
+	if s.defaultLimit < 1 || s.defaultLimit > s.maxLimit {
+		return nil, errors.New(
+			"hooked: the default page limit must be between 1 and the max")
+	}
+	if s.dispatcher != nil {
+		if c, ok := s.dispatcher.Sender.(push.Checker); ok {
+			s.checks = append(s.checks, namedCheck{"push", c.Check})
+		}
+	}
+	s.handler = s.routes()
+	s.httpServer = &http.Server{
+		Addr:         s.addr,
+		Handler:      s.handler,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		IdleTimeout:  s.idleTimeout,
+	}
+	return s, nil
+}
+
+func (s *Server) routes() http.Handler {
+	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			sendError(w, http.StatusNotFound, CodeNotFound, "No such endpoint.")
+		})
+	r.MethodNotAllowedHandler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			sendError(w, http.StatusMethodNotAllowed, CodeNotAllowed,
+				"Method not allowed.")
+		})
+	r.Use(s.requestIDMiddleware, metricsMiddleware)
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", s.healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", s.readyzHandler).Methods("GET")
+	r.HandleFunc("/version", s.versionHandler).Methods("GET")
+
+	// Everything else needs an API key, if auth is on.
+	api := r.NewRoute().Subrouter()
+	if s.auth {
+		api.Use(s.authMiddleware)
+	}
+	api.HandleFunc("/user/{id}/notifications",
+		s.requireSelf(s.getNotificationsHandler)).Methods("GET")
+	api.HandleFunc("/user/{id}/notifications/unread_count",
+		s.requireSelf(s.getUnreadCountHandler)).Methods("GET")
+	api.HandleFunc("/user/{id}/notifications/read",
+		s.requireSelf(s.markReadHandler)).Methods("POST")
+	api.HandleFunc("/activity",
+		s.rateLimit(s.postActivityHandler)).Methods("POST")
+	api.HandleFunc("/activity/{id}", s.deleteActivityHandler).Methods("DELETE")
+	if s.dispatcher != nil {
+		api.HandleFunc("/admin/push/dead",
+			s.requireAdmin(s.getDeadPushesHandler)).Methods("GET")
+		api.HandleFunc("/admin/push/{id}/replay",
+			s.requireAdmin(s.replayPushHandler)).Methods("POST")
+	}
+	return r
+}
+
+// Handler returns the server's HTTP handler, for use in tests.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// ListenAndServe starts the push dispatcher and serves HTTP until the
+// server is shut down.
+func (s *Server) ListenAndServe() error {
+	if s.dispatcher != nil {
+		s.dispatcher.Start()
+	}
+	return s.serve()
+}
+
+// serve serves HTTP until the server is shut down. The push dispatcher
+// must already be started.
+func (s *Server) serve() error {
+	s.logger.Info("Listening", "addr", s.addr)
+	err := s.httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	if s.dispatcher != nil {
+		s.dispatcher.Stop()
+	}
+	return err
+}
+
+// Shutdown stops accepting requests, waits for the in-flight ones, and
+// then drains the push dispatcher.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if s.dispatcher != nil {
+		if pushErr := s.dispatcher.Shutdown(ctx); err == nil {
+			err = pushErr
+		}
+	}
+	return err
+}
+
+// Run serves until the process gets SIGINT or SIGTERM, and then shuts down
+// gracefully.
+func (s *Server) Run() error {
+	// Start the dispatcher before anything can shut it down.
+	if s.dispatcher != nil {
+		s.dispatcher.Start()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.serve()
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		s.logger.Info("Shutting down", "signal", sig.String())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		s.shutdownTimeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if serveErr := <-errc; err == nil {
+		err = serveErr
+	}
+	return err
+}
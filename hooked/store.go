@@ -0,0 +1,138 @@
+package hooked
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+
+	"github.com/domino14/cool-api/push"
+)
+
+// The errors a Store returns for IDs it doesn't have.
+var (
+	ErrUserNotFound     = errors.New("User with that ID not found.")
+	ErrStoryNotFound    = errors.New("Story with that ID not found.")
+	ErrActivityNotFound = errors.New("Activity with that ID not found.")
+)
+
+// UserStore looks up users.
+type UserStore interface {
+	GetUser(ctx context.Context, id string) (*User, error)
+}
+
+// StoryStore looks up stories.
+type StoryStore interface {
+	GetStory(ctx context.Context, id string) (*Story, error)
+}
+
+// ActivityStore records activities.
+type ActivityStore interface {
+	InsertActivity(ctx context.Context, a *Activity) error
+	// GetActivity returns the activity with the given ID, unless it has
+	// been deleted.
+	GetActivity(ctx context.Context, id string) (*Activity, error)
+	// FindActivities returns the IDs of the actor's activities of the
+	// action on the story, leaving out deleted ones.
+	FindActivities(ctx context.Context, actor, action, story string) (
+		[]string, error)
+	// DeleteActivity marks the activity deleted, and deletes the
+	// notifications it made, merged ones included. It returns
+	// ErrActivityNotFound if it was already deleted.
+	DeleteActivity(ctx context.Context, id string) error
+}
+
+// FollowerStore keeps track of who follows whom.
+type FollowerStore interface {
+	// GetFollowerIDs returns the IDs of the users following the user
+	// with the given ID.
+	GetFollowerIDs(ctx context.Context, id string) ([]string, error)
+	// AddFollower records that the follower has followed the user since
+	// the given date. Following again doesn't change the date.
+	AddFollower(ctx context.Context, userID, followerID, since string) error
+	// RemoveFollower records that the follower no longer follows the
+	// user. It's not an error if they didn't. Notifications that were
+	// merged into the follower's feed by fan-out-on-read are written out,
+	// so that the follower keeps them.
+	RemoveFollower(ctx context.Context, userID, followerID string) error
+}
+
+// NotificationStore holds every user's notifications.
+type NotificationStore interface {
+	// GetNotifications gets a page of the user's notifications.
+	GetNotifications(ctx context.Context, user *User,
+		q NotificationQuery) (*NotificationPage, error)
+	// AddNotifications gives a copy of n to each of the notified users.
+	AddNotifications(ctx context.Context, notifiedIDs []string,
+		n Notification) error
+	// DeleteNotifications deletes the notified user's notifications of
+	// the action by the actor, and returns how many there were.
+	DeleteNotifications(ctx context.Context, notifiedID, actorID,
+		action string) (int, error)
+	// FanOut gives n, which is about activity a, to all of a's actor's
+	// followers, and returns how many followers there are. For accounts
+	// over the fan-out-on-read threshold nothing is written; instead,
+	// GetNotifications merges a into the followers' feeds as they read
+	// them. Either way the feeds look the same.
+	FanOut(ctx context.Context, a *Activity, n Notification) (int, error)
+	CountUnread(ctx context.Context, user *User) (int, error)
+	// MarkRead marks the user's notifications with the given IDs as read,
+	// and returns how many weren't read before.
+	MarkRead(ctx context.Context, user *User, ids []string) (int, error)
+	// MarkReadUpTo is like MarkRead, for every notification up to and
+	// including the cursor.
+	MarkReadUpTo(ctx context.Context, user *User, c Cursor) (int, error)
+}
+
+// PushQueue holds push notifications until they are delivered.
+type PushQueue interface {
+	QueuePush(ctx context.Context, msgs ...push.Message) error
+}
+
+// Store is everything the API needs to persist. See NewPostgresStore and
+// NewMemoryStore.
+type Store interface {
+	UserStore
+	StoryStore
+	ActivityStore
+	FollowerStore
+	NotificationStore
+	PushQueue
+	KeyStore
+	IdempotencyStore
+
+	// Atomic calls fn with a Store whose writes all happen in one
+	// transaction. The transaction is committed if fn returns nil, and
+	// rolled back otherwise.
+	Atomic(ctx context.Context, fn func(Store) error) error
+}
+
+type storeConfig struct {
+	fanoutThreshold int
+}
+
+// fanoutOnRead reports whether an account with the given number of
+// followers is big enough for fan-out-on-read.
+func (c storeConfig) fanoutOnRead(followers int) bool {
+	return c.fanoutThreshold > 0 && followers > c.fanoutThreshold
+}
+
+// mergedID is the ID of the notification that the activity is merged into
+// the user's feed as by fan-out-on-read. It's a UUID, like the IDs of
+// notifications that were written out, and always the same for the same
+// activity and user. feedSQL makes the same IDs.
+func mergedID(activityID, userID string) string {
+	sum := md5.Sum([]byte(activityID + "|" + userID))
+	h := hex.EncodeToString(sum[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// A StoreOption configures a Store.
+type StoreOption func(*storeConfig)
+
+// WithFanoutOnRead makes activities by accounts with more than threshold
+// followers fan out on read rather than on write. Zero, the default, means
+// always fan out on write.
+func WithFanoutOnRead(threshold int) StoreOption {
+	return func(c *storeConfig) { c.fanoutThreshold = threshold }
+}
@@ -0,0 +1,632 @@
+package hooked
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/domino14/cool-api/push"
+	"github.com/satori/go.uuid"
+)
+
+type memNotification struct {
+	id         string
+	notifiedID string
+	date       time.Time
+	readAt     time.Time
+	n          Notification
+	// merged is set for notifications merged in from a fan-out-on-read
+	// activity; their ID comes from mergedID.
+	merged bool
+}
+
+// memState is everything a MemoryStore holds. It is copied wholesale to
+// roll back a failed transaction.
+type memState struct {
+	users      map[string]User
+	stories    map[string]Story
+	activities []Activity
+	// fanoutOnRead has the IDs of activities whose notifications are
+	// merged into feeds when read.
+	fanoutOnRead map[string]bool
+	// followers maps user ID -> follower ID -> since when.
+	followers     map[string]map[string]time.Time
+	notifications []memNotification
+	// reads maps user ID -> merged activity ID -> when it was read.
+	reads  map[string]map[string]time.Time
+	pushes []push.Message
+	// keys maps key hash -> key. Revoked keys are deleted.
+	keys map[string]APIKey
+	// deleted has the IDs of deleted activities.
+	deleted map[string]bool
+	// idempotent maps idempotency key owner -> key -> request.
+	idempotent map[string]map[string]IdempotentRequest
+}
+
+func (st *memState) clone() *memState {
+	c := &memState{
+		users:         make(map[string]User, len(st.users)),
+		stories:       make(map[string]Story, len(st.stories)),
+		activities:    append([]Activity(nil), st.activities...),
+		fanoutOnRead:  make(map[string]bool, len(st.fanoutOnRead)),
+		followers:     cloneTimes(st.followers),
+		notifications: append([]memNotification(nil), st.notifications...),
+		reads:         cloneTimes(st.reads),
+		pushes:        append([]push.Message(nil), st.pushes...),
+		keys:          make(map[string]APIKey, len(st.keys)),
+		deleted:       make(map[string]bool, len(st.deleted)),
+		idempotent: make(map[string]map[string]IdempotentRequest,
+			len(st.idempotent)),
+	}
+	for k, v := range st.users {
+		c.users[k] = v
+	}
+	for k, v := range st.stories {
+		c.stories[k] = v
+	}
+	for k, v := range st.fanoutOnRead {
+		c.fanoutOnRead[k] = v
+	}
+	for k, v := range st.keys {
+		c.keys[k] = v
+	}
+	for k, v := range st.deleted {
+		c.deleted[k] = v
+	}
+	for owner, reqs := range st.idempotent {
+		inner := make(map[string]IdempotentRequest, len(reqs))
+		for k, v := range reqs {
+			inner[k] = v
+		}
+		c.idempotent[owner] = inner
+	}
+	return c
+}
+
+func cloneTimes(m map[string]map[string]time.Time) map[string]map[string]time.Time {
+	c := make(map[string]map[string]time.Time, len(m))
+	for k, v := range m {
+		inner := make(map[string]time.Time, len(v))
+		for k2, t := range v {
+			inner[k2] = t
+		}
+		c[k] = inner
+	}
+	return c
+}
+
+// MemoryStore is a Store that keeps everything in memory. It is meant for
+// tests and local experiments; nothing survives a restart.
+type MemoryStore struct {
+	cfg storeConfig
+	// txMu serializes transactions, mu guards st.
+	txMu sync.Mutex
+	mu   sync.RWMutex
+	st   *memState
+}
+
+func NewMemoryStore(opts ...StoreOption) *MemoryStore {
+	m := &MemoryStore{st: &memState{
+		users:        map[string]User{},
+		stories:      map[string]Story{},
+		fanoutOnRead: map[string]bool{},
+		followers:    map[string]map[string]time.Time{},
+		reads:        map[string]map[string]time.Time{},
+		keys:         map[string]APIKey{},
+		deleted:      map[string]bool{},
+		idempotent:   map[string]map[string]IdempotentRequest{},
+	}}
+	for _, opt := range opts {
+		opt(&m.cfg)
+	}
+	return m
+}
+
+// AddUser adds a user to the store.
+func (m *MemoryStore) AddUser(u User) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.st.users[u.ID] = u
+}
+
+// AddStory adds a story to the store.
+func (m *MemoryStore) AddStory(s Story) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.st.stories[s.ID] = s
+}
+
+// Activities returns every activity saved so far, oldest first.
+func (m *MemoryStore) Activities() []Activity {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Activity(nil), m.st.activities...)
+}
+
+// Pushes returns every push notification queued so far, less the ones
+// cancelled by deleting their activity.
+func (m *MemoryStore) Pushes() []push.Message {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]push.Message(nil), m.st.pushes...)
+}
+
+// Atomic runs fn against the store itself. If fn fails, the store is put
+// back the way it was before fn ran. Transactions don't run concurrently.
+func (m *MemoryStore) Atomic(ctx context.Context, fn func(Store) error) error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+	m.mu.RLock()
+	saved := m.st.clone()
+	m.mu.RUnlock()
+	err := fn(memTx{m})
+	if err != nil {
+		m.mu.Lock()
+		m.st = saved
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// memTx is a MemoryStore in a transaction. Atomic on it joins the
+// transaction rather than waiting for it.
+type memTx struct {
+	*MemoryStore
+}
+
+func (t memTx) Atomic(ctx context.Context, fn func(Store) error) error {
+	return fn(t)
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, id string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.st.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &u, nil
+}
+
+func (m *MemoryStore) GetStory(ctx context.Context, id string) (*Story, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.st.stories[id]
+	if !ok {
+		return nil, ErrStoryNotFound
+	}
+	return &s, nil
+}
+
+func (m *MemoryStore) InsertActivity(ctx context.Context, a *Activity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.st.activities = append(m.st.activities, *a)
+	return nil
+}
+
+func (m *MemoryStore) GetActivity(ctx context.Context, id string) (
+	*Activity, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, a := range m.st.activities {
+		if a.ID == id && !m.st.deleted[id] {
+			return &a, nil
+		}
+	}
+	return nil, ErrActivityNotFound
+}
+
+func (m *MemoryStore) FindActivities(ctx context.Context,
+	actor, action, story string) ([]string, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := []string{}
+	for _, a := range m.st.activities {
+		if a.Actor == actor && a.Action == action && a.Story == story &&
+			!m.st.deleted[a.ID] {
+			ids = append(ids, a.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (m *MemoryStore) DeleteActivity(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	for _, a := range m.st.activities {
+		found = found || a.ID == id
+	}
+	if !found || m.st.deleted[id] {
+		return ErrActivityNotFound
+	}
+	m.st.deleted[id] = true
+	kept := m.st.notifications[:0]
+	for _, row := range m.st.notifications {
+		if row.n.activityID != id {
+			kept = append(kept, row)
+		}
+	}
+	m.st.notifications = kept
+	for _, reads := range m.st.reads {
+		delete(reads, id)
+	}
+	pushes := m.st.pushes[:0]
+	for _, msg := range m.st.pushes {
+		if msg.ActivityID != id {
+			pushes = append(pushes, msg)
+		}
+	}
+	m.st.pushes = pushes
+	return nil
+}
+
+func (m *MemoryStore) GetFollowerIDs(ctx context.Context, id string) (
+	[]string, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := []string{}
+	for f := range m.st.followers[id] {
+		ids = append(ids, f)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (m *MemoryStore) AddFollower(ctx context.Context,
+	userID, followerID, since string) error {
+
+	date, err := time.Parse(HookedRFC, since)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.st.followers[userID] == nil {
+		m.st.followers[userID] = map[string]time.Time{}
+	}
+	if _, ok := m.st.followers[userID][followerID]; !ok {
+		m.st.followers[userID][followerID] = date
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveFollower(ctx context.Context,
+	userID, followerID string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The follower entry is what merges fan-out-on-read activities into
+	// the follower's feed, so first write out the ones merged so far.
+	for _, a := range m.st.activities {
+		if a.Actor != userID {
+			continue
+		}
+		if row, ok := m.merged(a, followerID); ok {
+			row.merged = false
+			m.st.notifications = append(m.st.notifications, row)
+			delete(m.st.reads[followerID], a.ID)
+		}
+	}
+	delete(m.st.followers[userID], followerID)
+	return nil
+}
+
+func (m *MemoryStore) DeleteNotifications(ctx context.Context, notifiedID,
+	actorID, action string) (int, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.st.notifications[:0]
+	for _, row := range m.st.notifications {
+		if row.notifiedID != notifiedID || row.n.Actor != actorID ||
+			row.n.Action != action {
+			kept = append(kept, row)
+		}
+	}
+	n := len(m.st.notifications) - len(kept)
+	m.st.notifications = kept
+	return n, nil
+}
+
+func (m *MemoryStore) AddNotifications(ctx context.Context,
+	notifiedIDs []string, n Notification) error {
+
+	date, err := time.Parse(HookedRFC, n.Date)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, notifiedID := range notifiedIDs {
+		m.st.notifications = append(m.st.notifications, memNotification{
+			id:         uuid.NewV4().String(),
+			notifiedID: notifiedID,
+			date:       date,
+			n:          n,
+		})
+	}
+	return nil
+}
+
+func (m *MemoryStore) FanOut(ctx context.Context, a *Activity,
+	n Notification) (int, error) {
+
+	followers, err := m.GetFollowerIDs(ctx, a.Actor)
+	if err != nil {
+		return 0, err
+	}
+	if m.cfg.fanoutOnRead(len(followers)) {
+		m.mu.Lock()
+		m.st.fanoutOnRead[a.ID] = true
+		m.mu.Unlock()
+		return len(followers), nil
+	}
+	return len(followers), m.AddNotifications(ctx, followers, n)
+}
+
+// feed returns all of the user's notifications, including the merged
+// ones, in no particular order. The caller must hold mu.
+func (m *MemoryStore) feed(user *User) []memNotification {
+	var rows []memNotification
+	for _, row := range m.st.notifications {
+		if row.notifiedID == user.ID {
+			rows = append(rows, row)
+		}
+	}
+	for _, a := range m.st.activities {
+		if row, ok := m.merged(a, user.ID); ok {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// merged returns the notification that a is merged into the user's feed
+// as, if it is. The caller must hold mu.
+func (m *MemoryStore) merged(a Activity, userID string) (
+	memNotification, bool) {
+
+	if !m.st.fanoutOnRead[a.ID] || m.st.deleted[a.ID] {
+		return memNotification{}, false
+	}
+	since, ok := m.st.followers[a.Actor][userID]
+	date, err := time.Parse(HookedRFC, a.Date)
+	if !ok || err != nil || date.Before(since) {
+		return memNotification{}, false
+	}
+	n := Notification{Action: a.Action, Actor: a.Actor, Date: a.Date,
+		activityID: a.ID}
+	if a.Action != ActionWrite {
+		n.Story = a.Story
+	}
+	return memNotification{
+		id:         mergedID(a.ID, userID),
+		notifiedID: userID,
+		date:       date,
+		readAt:     m.st.reads[userID][a.ID],
+		n:          n,
+		merged:     true,
+	}, true
+}
+
+func (m *MemoryStore) GetNotifications(ctx context.Context, user *User,
+	q NotificationQuery) (*NotificationPage, error) {
+
+	m.mu.RLock()
+	var rows []memNotification
+	for _, row := range m.feed(user) {
+		if q.matches(row) {
+			rows = append(rows, row)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if !a.date.Equal(b.date) {
+			return a.date.After(b.date) != q.Ascending
+		}
+		return (a.id > b.id) != q.Ascending
+	})
+	if len(rows) > q.Limit+1 {
+		rows = rows[:q.Limit+1]
+	}
+	notifications := []Notification{}
+	for _, row := range rows {
+		notification := row.n
+		notification.ID = row.id
+		notification.at = row.date
+		if !row.readAt.IsZero() {
+			notification.ReadAt = row.readAt.Format(HookedRFC)
+		}
+		if notification.Action == ActionFollow {
+			notification.User2 = user.ID
+		}
+		notifications = append(notifications, notification)
+	}
+	return newNotificationPage(notifications, q.Limit), nil
+}
+
+// matches reports whether the query's filters and bounds let row through.
+func (q NotificationQuery) matches(row memNotification) bool {
+	switch {
+	case q.Action != "" && row.n.Action != q.Action,
+		q.Actor != "" && row.n.Actor != q.Actor,
+		q.Story != "" && row.n.Story != q.Story,
+		q.Unread && !row.readAt.IsZero(),
+		!q.Since.IsZero() && row.date.Before(q.Since),
+		!q.Until.IsZero() && !row.date.Before(q.Until),
+		q.Before != nil && !q.Before.after(row.date, row.id),
+		q.After != nil && !q.After.before(row.date, row.id):
+		return false
+	}
+	return true
+}
+
+func (m *MemoryStore) QueuePush(ctx context.Context,
+	msgs ...push.Message) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.st.pushes = append(m.st.pushes, msgs...)
+	return nil
+}
+
+func (m *MemoryStore) CountUnread(ctx context.Context, user *User) (int,
+	error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, row := range m.feed(user) {
+		if row.readAt.IsZero() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryStore) MarkRead(ctx context.Context, user *User,
+	ids []string) (int, error) {
+
+	want := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	return m.markRead(user, func(row memNotification) bool {
+		return want[row.id]
+	}), nil
+}
+
+func (m *MemoryStore) MarkReadUpTo(ctx context.Context, user *User,
+	c Cursor) (int, error) {
+
+	return m.markRead(user, func(row memNotification) bool {
+		return !c.before(row.date, row.id)
+	}), nil
+}
+
+// markRead marks the user's unread notifications that match as read.
+func (m *MemoryStore) markRead(user *User,
+	match func(memNotification) bool) int {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	index := make(map[string]int, len(m.st.notifications))
+	for i, row := range m.st.notifications {
+		index[row.id] = i
+	}
+	n := 0
+	for _, row := range m.feed(user) {
+		if !row.readAt.IsZero() || !match(row) {
+			continue
+		}
+		n++
+		if row.merged {
+			if m.st.reads[user.ID] == nil {
+				m.st.reads[user.ID] = map[string]time.Time{}
+			}
+			m.st.reads[user.ID][row.n.activityID] = now
+			continue
+		}
+		m.st.notifications[index[row.id]].readAt = now
+	}
+	return n
+}
+
+func (m *MemoryStore) GetAPIKey(ctx context.Context, hash string) (*APIKey,
+	error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok := m.st.keys[hash]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return &k, nil
+}
+
+func (m *MemoryStore) AddAPIKey(ctx context.Context, k *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.st.keys[k.Hash] = *k
+	return nil
+}
+
+func (m *MemoryStore) RevokeAPIKey(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for hash, k := range m.st.keys {
+		if k.ID == id {
+			delete(m.st.keys, hash)
+			return nil
+		}
+	}
+	return ErrKeyNotFound
+}
+
+func (m *MemoryStore) ClaimIdempotencyKey(ctx context.Context,
+	req *IdempotentRequest) (*IdempotentRequest, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reqs := m.st.idempotent[req.Owner]
+	if prev, ok := reqs[req.Key]; ok && prev.ExpiresAt.After(time.Now()) {
+		return &prev, nil
+	}
+	if reqs == nil {
+		reqs = map[string]IdempotentRequest{}
+		m.st.idempotent[req.Owner] = reqs
+	}
+	reqs[req.Key] = *req
+	return nil, nil
+}
+
+func (m *MemoryStore) GetIdempotentRequest(ctx context.Context,
+	owner, key string) (*IdempotentRequest, error) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	req, ok := m.st.idempotent[owner][key]
+	if !ok || !req.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &req, nil
+}
+
+func (m *MemoryStore) SetIdempotentResponse(ctx context.Context,
+	req *IdempotentRequest) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.st.idempotent[req.Owner][req.Key] = *req
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpiredIdempotencyKeys(ctx context.Context) (
+	int, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for owner, reqs := range m.st.idempotent {
+		for k, req := range reqs {
+			if !req.ExpiresAt.After(now) {
+				delete(reqs, k)
+				n++
+			}
+		}
+		if len(reqs) == 0 {
+			delete(m.st.idempotent, owner)
+		}
+	}
+	return n, nil
+}
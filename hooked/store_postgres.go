@@ -0,0 +1,677 @@
+package hooked
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/domino14/cool-api/push"
+	"github.com/lib/pq"
+	"github.com/satori/go.uuid"
+)
+
+// querier is satisfied by both *sql.DB and *sql.Tx, so that the same
+// queries can run either on their own or as part of a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string,
+		args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string,
+		args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string,
+		args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+type pgStore struct {
+	db  *sql.DB
+	cfg storeConfig
+	// q is db, or the transaction we're in.
+	q querier
+}
+
+// NewPostgresStore returns a Store backed by the given database.
+func NewPostgresStore(db *sql.DB, opts ...StoreOption) Store {
+	s := &pgStore{db: db, q: db}
+	for _, opt := range opts {
+		opt(&s.cfg)
+	}
+	return s
+}
+
+func (s *pgStore) Atomic(ctx context.Context, fn func(Store) error) error {
+	if _, ok := s.q.(*sql.Tx); ok {
+		// Already in a transaction; just join it.
+		return fn(s)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(&pgStore{db: s.db, cfg: s.cfg, q: tx})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullable turns empty strings into NULLs.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (s *pgStore) InsertActivity(ctx context.Context, a *Activity) error {
+	_, err := s.q.ExecContext(ctx, `
+        INSERT into activities (sid, action, date, actor_id, user2_id, story_id)
+        VALUES($1, $2, $3, $4, $5, $6)
+    `, a.ID, a.Action, a.Date, a.Actor, nullable(a.User2), nullable(a.Story))
+	return err
+}
+
+func (s *pgStore) GetActivity(ctx context.Context, id string) (*Activity,
+	error) {
+
+	a := &Activity{ID: id}
+	var date time.Time
+	var user2, story sql.NullString
+	err := s.q.QueryRowContext(ctx, `
+        SELECT action, date, actor_id, user2_id, story_id FROM activities
+        WHERE sid = $1 AND deleted_at IS NULL
+    `, id).Scan(&a.Action, &date, &a.Actor, &user2, &story)
+	if err == sql.ErrNoRows {
+		return nil, ErrActivityNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.Date = date.Format(HookedRFC)
+	a.User2, a.Story = user2.String, story.String
+	return a, nil
+}
+
+func (s *pgStore) FindActivities(ctx context.Context,
+	actor, action, story string) ([]string, error) {
+
+	ids := []string{}
+	rows, err := s.q.QueryContext(ctx, `
+        SELECT sid FROM activities
+        WHERE actor_id = $1 AND action = $2 AND story_id = $3
+            AND deleted_at IS NULL
+    `, actor, action, story)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *pgStore) DeleteActivity(ctx context.Context, id string) error {
+	return s.Atomic(ctx, func(tx Store) error {
+		q := tx.(*pgStore).q
+		res, err := q.ExecContext(ctx, `
+            UPDATE activities SET deleted_at = now()
+            WHERE sid = $1 AND deleted_at IS NULL
+        `, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrActivityNotFound
+		}
+		// Merged notifications are left out of feeds once the activity is
+		// deleted, so just their read state goes.
+		for _, table := range []string{"notifications", "notification_reads"} {
+			_, err = q.ExecContext(ctx,
+				"DELETE FROM "+table+" WHERE activity_id = $1", id)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = push.Cancel(ctx, q, id)
+		return err
+	})
+}
+
+func (s *pgStore) AddFollower(ctx context.Context,
+	userID, followerID, since string) error {
+
+	_, err := s.q.ExecContext(ctx, `
+        INSERT INTO followers (user_id, follower_id, since)
+        VALUES ($1, $2, $3)
+        ON CONFLICT DO NOTHING
+    `, userID, followerID, since)
+	return err
+}
+
+func (s *pgStore) RemoveFollower(ctx context.Context,
+	userID, followerID string) error {
+
+	// The follower row is what merges fan-out-on-read activities into the
+	// follower's feed, so first write out the ones merged so far, as fan-out
+	// on write would have.
+	return s.Atomic(ctx, func(tx Store) error {
+		q := tx.(*pgStore).q
+		rows, err := mergedRows(ctx, q, userID, followerID)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			err = copyIn(ctx, q, "notifications", []string{
+				"id", "notified_id", "actor_id", "action", "date", "story_id",
+				"read_at", "activity_id",
+			}, rows)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = q.ExecContext(ctx, `
+            DELETE FROM notification_reads
+            WHERE notified_id = $2 AND activity_id IN (
+                SELECT sid FROM activities WHERE actor_id = $1)
+        `, userID, followerID)
+		if err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, `
+            DELETE FROM followers WHERE user_id = $1 AND follower_id = $2
+        `, userID, followerID)
+		return err
+	})
+}
+
+// mergedRows returns the notifications rows for the user's fan-out-on-read
+// activities that are merged into the follower's feed.
+func mergedRows(ctx context.Context, q querier, userID, followerID string) (
+	[][]interface{}, error) {
+
+	rows, err := q.QueryContext(ctx, `
+        SELECT a.sid, a.action, a.date,
+            CASE WHEN a.action = 'write' THEN NULL ELSE a.story_id END,
+            r.read_at
+        FROM activities a
+        JOIN followers f ON f.user_id = a.actor_id AND f.follower_id = $2
+        LEFT JOIN notification_reads r
+            ON r.notified_id = $2 AND r.activity_id = a.sid
+        WHERE a.actor_id = $1 AND a.fanout_on_read AND a.date >= f.since
+            AND a.deleted_at IS NULL
+    `, userID, followerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var merged [][]interface{}
+	for rows.Next() {
+		var id, action string
+		var date time.Time
+		var storyID sql.NullString
+		var readAt pq.NullTime
+		err = rows.Scan(&id, &action, &date, &storyID, &readAt)
+		if err != nil {
+			return nil, err
+		}
+		// Written out, they keep their IDs.
+		merged = append(merged, []interface{}{mergedID(id, followerID),
+			followerID, userID, action, date, storyID, readAt, id})
+	}
+	return merged, rows.Err()
+}
+
+func (s *pgStore) DeleteNotifications(ctx context.Context, notifiedID,
+	actorID, action string) (int, error) {
+
+	res, err := s.q.ExecContext(ctx, `
+        DELETE FROM notifications
+        WHERE notified_id = $1 AND actor_id = $2 AND action = $3
+    `, notifiedID, actorID, action)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *pgStore) AddNotifications(ctx context.Context, notifiedIDs []string,
+	n Notification) error {
+
+	switch len(notifiedIDs) {
+	case 0:
+		return nil
+	case 1:
+		// Not worth a COPY.
+		_, err := s.q.ExecContext(ctx, `
+            INSERT into notifications
+            (id, notified_id, actor_id, action, date, story_id, activity_id)
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+        `, uuid.NewV4(), notifiedIDs[0], n.Actor, n.Action, n.Date,
+			nullable(n.Story), nullable(n.activityID))
+		return err
+	}
+	rows := make([][]interface{}, len(notifiedIDs))
+	for i, notifiedID := range notifiedIDs {
+		rows[i] = []interface{}{uuid.NewV4().String(), notifiedID, n.Actor,
+			n.Action, n.Date, nullable(n.Story), nullable(n.activityID)}
+	}
+	// COPY has to run in a transaction.
+	return s.Atomic(ctx, func(tx Store) error {
+		return copyIn(ctx, tx.(*pgStore).q, "notifications", []string{
+			"id", "notified_id", "actor_id", "action", "date", "story_id",
+			"activity_id",
+		}, rows)
+	})
+}
+
+// copyIn bulk-loads rows into table with COPY FROM STDIN, which is much
+// faster than inserting them one by one. q must be a transaction.
+func copyIn(ctx context.Context, q querier, table string, columns []string,
+	rows [][]interface{}) error {
+
+	stmt, err := q.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		_, err = stmt.ExecContext(ctx, row...)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	// An Exec without arguments flushes the buffered rows.
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+func (s *pgStore) FanOut(ctx context.Context, a *Activity,
+	n Notification) (int, error) {
+
+	followers, err := s.GetFollowerIDs(ctx, a.Actor)
+	if err != nil {
+		return 0, err
+	}
+	if s.cfg.fanoutOnRead(len(followers)) {
+		_, err = s.q.ExecContext(ctx, `
+            UPDATE activities SET fanout_on_read = true WHERE sid = $1
+        `, a.ID)
+		return len(followers), err
+	}
+	return len(followers), s.AddNotifications(ctx, followers, n)
+}
+
+// feedSQL selects all of the user in $1's notifications: their own, and
+// the ones merged in from fan-out-on-read activities by accounts they
+// follow. Merged notifications get their IDs from mergedID, keep their
+// read state in notification_reads, and have the activity's ID in
+// merged_from.
+const feedSQL = `
+    SELECT id::text AS id, actor_id, story_id, action, date, read_at,
+        NULL AS merged_from
+    FROM notifications
+    WHERE notified_id = $1
+    UNION ALL
+    SELECT md5(a.sid || '|' || $1)::uuid::text, a.actor_id,
+        CASE WHEN a.action = 'write' THEN NULL ELSE a.story_id END,
+        a.action, a.date, r.read_at, a.sid
+    FROM activities a
+    JOIN followers f ON f.user_id = a.actor_id AND f.follower_id = $1
+    LEFT JOIN notification_reads r
+        ON r.notified_id = $1 AND r.activity_id = a.sid
+    WHERE a.fanout_on_read AND a.date >= f.since AND a.deleted_at IS NULL
+`
+
+func (s *pgStore) QueuePush(ctx context.Context, msgs ...push.Message) error {
+	return push.Enqueue(ctx, s.q, msgs...)
+}
+
+func (s *pgStore) GetUser(ctx context.Context, id string) (*User, error) {
+	var firstname string
+	var lastname string
+	err := s.q.QueryRowContext(ctx,
+		"SELECT firstname, lastname FROM users WHERE sid = $1", id).Scan(
+		&firstname, &lastname)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &User{
+		FirstName: firstname,
+		LastName:  lastname,
+		ID:        id,
+	}, nil
+}
+
+func (s *pgStore) GetStory(ctx context.Context, id string) (*Story, error) {
+	var title string
+	var author string
+	err := s.q.QueryRowContext(ctx,
+		"SELECT title, author_id FROM stories WHERE sid = $1", id).Scan(
+		&title, &author)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrStoryNotFound
+		}
+		return nil, err
+	}
+	return &Story{
+		Title:  title,
+		Author: author, // This is still a User ID.
+		ID:     id,
+	}, nil
+}
+
+func (s *pgStore) GetFollowerIDs(ctx context.Context, id string) ([]string,
+	error) {
+
+	ids := []string{}
+	rows, err := s.q.QueryContext(ctx,
+		"SELECT follower_id FROM followers WHERE user_id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *pgStore) GetNotifications(ctx context.Context, user *User,
+	q NotificationQuery) (*NotificationPage, error) {
+
+	where := []string{"true"}
+	args := []interface{}{user.ID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q.Action != "" {
+		where = append(where, "action = "+arg(q.Action))
+	}
+	if q.Actor != "" {
+		where = append(where, "actor_id = "+arg(q.Actor))
+	}
+	if q.Story != "" {
+		where = append(where, "story_id = "+arg(q.Story))
+	}
+	if q.Unread {
+		where = append(where, "read_at IS NULL")
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "date >= "+arg(q.Since))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "date < "+arg(q.Until))
+	}
+	if q.Before != nil {
+		where = append(where, fmt.Sprintf("(date, id) < (%s, %s)",
+			arg(q.Before.Date), arg(q.Before.ID)))
+	}
+	if q.After != nil {
+		where = append(where, fmt.Sprintf("(date, id) > (%s, %s)",
+			arg(q.After.Date), arg(q.After.ID)))
+	}
+	order := "DESC"
+	if q.Ascending {
+		order = "ASC"
+	}
+
+	notifications := []Notification{}
+	rows, err := s.q.QueryContext(ctx, fmt.Sprintf(`
+        SELECT id, actor_id, story_id, action, date, read_at
+        FROM (%s) feed
+        WHERE %s
+        ORDER BY date %s, id %s
+        LIMIT %s
+    `, feedSQL, strings.Join(where, " AND "), order, order, arg(q.Limit+1)),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var actorID string
+		var storyID sql.NullString
+		var action string
+		var date time.Time
+		var readAt pq.NullTime
+		err = rows.Scan(&id, &actorID, &storyID, &action, &date, &readAt)
+		if err != nil {
+			return nil, err
+		}
+		notification := Notification{
+			ID:     id,
+			Action: action,
+			Actor:  actorID,
+			Date:   date.Format(HookedRFC),
+			at:     date,
+		}
+		if readAt.Valid {
+			notification.ReadAt = readAt.Time.Format(HookedRFC)
+		}
+		if !storyID.Valid {
+			notification.Story = "" // Will be removed from struct by omitempty
+		} else {
+			notification.Story = storyID.String
+		}
+		if action == ActionFollow {
+			// The user is the followed (who would get the notification),
+			// actor is the follower
+			notification.User2 = user.ID
+		}
+		notifications = append(notifications, notification)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newNotificationPage(notifications, q.Limit), nil
+}
+
+func (s *pgStore) CountUnread(ctx context.Context, user *User) (int, error) {
+	var n int
+	err := s.q.QueryRowContext(ctx, `
+        SELECT count(*) FROM (`+feedSQL+`) feed WHERE read_at IS NULL
+    `, user.ID).Scan(&n)
+	return n, err
+}
+
+func (s *pgStore) MarkRead(ctx context.Context, user *User,
+	ids []string) (int, error) {
+
+	return s.markRead(ctx, user, "id = ANY($2)", pq.Array(ids))
+}
+
+func (s *pgStore) MarkReadUpTo(ctx context.Context, user *User,
+	c Cursor) (int, error) {
+
+	return s.markRead(ctx, user, "(date, id) <= ($2, $3)", c.Date, c.ID)
+}
+
+// markRead marks the user's unread notifications matching cond as read.
+// cond is a condition on feedSQL's columns, with parameters from $2 on.
+func (s *pgStore) markRead(ctx context.Context, user *User, cond string,
+	args ...interface{}) (int, error) {
+
+	args = append([]interface{}{user.ID}, args...)
+	var n int
+	err := s.Atomic(ctx, func(tx Store) error {
+		q := tx.(*pgStore).q
+		res, err := q.ExecContext(ctx, `
+            UPDATE notifications SET read_at = now()
+            WHERE id::text IN (
+                SELECT id FROM (`+feedSQL+`) feed
+                WHERE merged_from IS NULL AND read_at IS NULL AND `+cond+`
+            ) AND notified_id = $1
+        `, args...)
+		if err != nil {
+			return err
+		}
+		updated, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		// Merged notifications have no row of their own to update.
+		res, err = q.ExecContext(ctx, `
+            INSERT INTO notification_reads (notified_id, activity_id, read_at)
+            SELECT $1, merged_from, now()
+            FROM (`+feedSQL+`) feed
+            WHERE merged_from IS NOT NULL AND read_at IS NULL AND `+cond+`
+            ON CONFLICT DO NOTHING
+        `, args...)
+		if err != nil {
+			return err
+		}
+		inserted, err := res.RowsAffected()
+		n = int(updated + inserted)
+		return err
+	})
+	return n, err
+}
+
+func (s *pgStore) GetAPIKey(ctx context.Context, hash string) (*APIKey,
+	error) {
+
+	k := &APIKey{Hash: hash}
+	var userID sql.NullString
+	err := s.q.QueryRowContext(ctx, `
+        SELECT id, user_id, admin, created_at FROM api_keys
+        WHERE key_hash = $1 AND revoked_at IS NULL
+    `, hash).Scan(&k.ID, &userID, &k.Admin, &k.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.UserID = userID.String
+	return k, nil
+}
+
+func (s *pgStore) AddAPIKey(ctx context.Context, k *APIKey) error {
+	_, err := s.q.ExecContext(ctx, `
+        INSERT INTO api_keys (id, key_hash, user_id, admin, created_at)
+        VALUES ($1, $2, $3, $4, $5)
+    `, k.ID, k.Hash, nullable(k.UserID), k.Admin, k.CreatedAt)
+	return err
+}
+
+func (s *pgStore) RevokeAPIKey(ctx context.Context, id string) error {
+	if _, err := uuid.FromString(id); err != nil {
+		return ErrKeyNotFound
+	}
+	res, err := s.q.ExecContext(ctx, `
+        UPDATE api_keys SET revoked_at = now()
+        WHERE id = $1 AND revoked_at IS NULL
+    `, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) ClaimIdempotencyKey(ctx context.Context,
+	req *IdempotentRequest) (*IdempotentRequest, error) {
+
+	// If another transaction has the key, this waits for it to commit or
+	// roll back, and then either finds its request or claims the key.
+	var claimed int
+	err := s.q.QueryRowContext(ctx, `
+        INSERT INTO idempotency_keys AS k
+            (owner, key, fingerprint, status, body, expires_at)
+        VALUES ($1, $2, $3, 0, '', $4)
+        ON CONFLICT (owner, key) DO UPDATE SET
+            fingerprint = EXCLUDED.fingerprint, status = 0, body = '',
+            expires_at = EXCLUDED.expires_at
+        WHERE k.expires_at <= now()
+        RETURNING 1
+    `, req.Owner, req.Key, req.Fingerprint, req.ExpiresAt).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	prev := &IdempotentRequest{Owner: req.Owner, Key: req.Key}
+	err = s.q.QueryRowContext(ctx, `
+        SELECT fingerprint, status, body, expires_at FROM idempotency_keys
+        WHERE owner = $1 AND key = $2
+    `, req.Owner, req.Key).Scan(&prev.Fingerprint, &prev.Status, &prev.Body,
+		&prev.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return prev, nil
+}
+
+func (s *pgStore) GetIdempotentRequest(ctx context.Context,
+	owner, key string) (*IdempotentRequest, error) {
+
+	req := &IdempotentRequest{Owner: owner, Key: key}
+	err := s.q.QueryRowContext(ctx, `
+        SELECT fingerprint, status, body, expires_at FROM idempotency_keys
+        WHERE owner = $1 AND key = $2 AND expires_at > now()
+    `, owner, key).Scan(&req.Fingerprint, &req.Status, &req.Body,
+		&req.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *pgStore) SetIdempotentResponse(ctx context.Context,
+	req *IdempotentRequest) error {
+
+	_, err := s.q.ExecContext(ctx, `
+        UPDATE idempotency_keys SET status = $3, body = $4
+        WHERE owner = $1 AND key = $2
+    `, req.Owner, req.Key, req.Status, req.Body)
+	return err
+}
+
+func (s *pgStore) DeleteExpiredIdempotencyKeys(ctx context.Context) (int,
+	error) {
+
+	res, err := s.q.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
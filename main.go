@@ -1,134 +1,376 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	_ "github.com/lib/pq"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/domino14/cool-api/config"
 	"github.com/domino14/cool-api/hooked"
+	"github.com/domino14/cool-api/logging"
+	"github.com/domino14/cool-api/migrations"
+	"github.com/domino14/cool-api/push"
+)
+
+// Build metadata, set at link time with e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)
+//	    -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 // A database creation function. On production this shouldn't exist,
 // we need it here for initial bootstrapping.
-func createDB(user, pass, host, port, dbName string) {
-	connString := fmt.Sprintf(
-		"postgres://%s:%s@%s:%s/?sslmode=disable", user, pass, host, port)
+func createDB(c config.DB) {
+	connString := fmt.Sprintf("postgres://%s:%s@%s:%d/?sslmode=%s",
+		c.User, c.Password, c.Host, c.Port, c.SSLMode)
 	db, err := sql.Open("postgres", connString)
 	if err != nil {
-		log.Fatal(err)
+		fatal("open-db", err)
 	}
-	log.Printf("[DEBUG] Created db object")
+	slog.Debug("Created db object")
 
-	_, err = db.Exec("CREATE DATABASE " + dbName)
+	_, err = db.Exec("CREATE DATABASE " + c.Name)
 
 	if err != nil {
 		// Probably OK, the database already exists.
-		log.Printf("[INFO] Error creating database: %s", err)
+		slog.Info("Error creating database", "err", err)
 	}
 }
 
-// Create database if it doesn't exist, and load initial fixtures.
-func initializeDB() *sql.DB {
-	// Env vars from local_config.env
-	user := os.Getenv("DB_USER")
-	pass := os.Getenv("DB_PASS")
-	host := os.Getenv("DB_HOST")
-	port := os.Getenv("DB_PORT")
-	dbName := os.Getenv("DB_NAME")
-
-	createDB(user, pass, host, port, dbName)
+// Create database if it doesn't exist, and connect to it.
+func connectDB(c config.DB) *sql.DB {
+	createDB(c)
 
-	connString := fmt.Sprintf(
-		"postgres://%s:%s@%s:%s/%s?sslmode=disable", user, pass, host, port,
-		dbName)
+	connString := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
+		c.User, c.Password, c.Host, c.Port, c.Name, c.SSLMode)
 	db, err := sql.Open("postgres", connString)
 	if err != nil {
-		log.Fatal(err)
+		fatal("open-db", err)
 	}
 	if err := db.Ping(); err != nil {
-		log.Fatal(err)
+		fatal("ping-db", err)
 	}
-	log.Printf("[DEBUG] Connected to database %s", dbName)
+	slog.Debug("Connected to database", "name", c.Name)
+	return db
+}
 
-	// Create tables if they don't exist.
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS users(
-            sid varchar(24) primary key,
-            firstname varchar(40) NOT NULL,
-            lastname varchar(40) NOT NULL
-        )`)
-	if err != nil {
-		log.Printf("[INFO] Create table users error: %s", err)
-	}
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS stories(
-            sid varchar(24) primary key,
-            title varchar(128) NOT NULL,
-            author_id varchar(24) REFERENCES users(sid)
-        )`)
+// Connect, and bring the schema up to date.
+func initializeDB(c config.DB) *sql.DB {
+	db := connectDB(c)
+	applied, err := migrations.Up(context.Background(), db)
 	if err != nil {
-		log.Printf("[INFO] Create table stories error: %s", err)
-	}
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS activities(
-            sid varchar(24) primary key,
-            action varchar(24) NOT NULL,
-            date timestamptz NOT NULL,
-            actor_id varchar(24) REFERENCES users(sid),
-            story_id varchar(24) REFERENCES stories(sid),
-            user2_id varchar(24) REFERENCES users(sid)
-        )`)
-	if err != nil {
-		log.Printf("[INFO] Create table activities error: %s", err)
+		fatal("migrate", err)
+	}
+	for _, m := range applied {
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
 	}
+	return db
+}
 
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS followers(
-            user_id varchar(24) REFERENCES users(sid),
-            follower_id varchar(24) REFERENCES users(sid),
-            primary key (user_id, follower_id)
-        )
-    `)
-	if err != nil {
-		log.Printf("[INFO] Create table followers error: %s", err)
-	}
-
-	// Technically notifications can be computed from the activities,
-	// but that is inefficient. Let's instead create a notifications
-	// table.
-	// In this case, the `notified` is the user whose notification we are getting.
-	// The `actor` is the performer of the action, which is not necessarily
-	// the same as the notified user.
-	// In the case of a follow, it will be mapped to `user2` in the API output.
-	// Story is null if this is a follow.
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS notifications(
-            id uuid primary key,
-            notified_id varchar(24) REFERENCES users(sid),
-            actor_id varchar(24) REFERENCES users(sid),
-            action varchar(24) NOT NULL,
-            date timestamptz NOT NULL,
-            story_id varchar(24) REFERENCES stories(sid)
-        )`)
+// The API and seed must use the same store options, so that seeded data
+// looks like live data.
+func storeOptions(cfg *config.Config) []hooked.StoreOption {
+	return []hooked.StoreOption{
+		hooked.WithFanoutOnRead(cfg.Feed.FanoutOnReadThreshold),
+	}
+}
+
+// Create the push dispatcher, delivering through the configured sender.
+func initializePush(db *sql.DB, c config.Push) *push.Dispatcher {
+	sender, err := push.New(c.Backend, push.Config{
+		Endpoint:  c.Endpoint,
+		AuthToken: c.AuthToken,
+		Timeout:   c.Timeout,
+	})
 	if err != nil {
-		log.Printf("[INFO] Create table notifications error: %s", err)
+		fatal("push-backend", err)
 	}
+	slog.Debug("Using push backend", "backend", c.Backend)
 
-	// Note: It seems worthwhile to create tables for loves,
-	// comments, likes, etc in the future. For now let's use the activities
-	// table as the source of truth.
+	dispatcher := push.NewDispatcher(push.NewOutbox(db), sender)
+	dispatcher.Workers = c.Workers
+	dispatcher.MaxAttempts = c.MaxAttempts
+	return dispatcher
+}
 
-	log.Printf("[DEBUG] Loading initial fixtures...")
-	hooked.LoadFixtures(db) // in loader.go
-	log.Printf("[DEBUG] Done loading fixtures")
-	return db
+// Create the rate limiter for posting activities.
+func initializeRateLimit(db *sql.DB, c config.RateLimit) hooked.Option {
+	limiter := hooked.NewMemoryLimiter()
+	if c.Backend == "postgres" {
+		limiter = hooked.NewPostgresLimiter(db)
+	}
+	// Validated with the rest of the config.
+	proxies, _ := c.Proxies()
+	return hooked.WithRateLimit(limiter, hooked.RateLimits{
+		IP:             hooked.PerMinute(c.IP),
+		TrustedProxies: proxies,
+		Actions: map[string]hooked.Limit{
+			hooked.ActionFollow:   hooked.PerMinute(c.Follow),
+			hooked.ActionUnfollow: hooked.PerMinute(c.Unfollow),
+			hooked.ActionLove:     hooked.PerMinute(c.Love),
+			hooked.ActionUnlove:   hooked.PerMinute(c.Unlove),
+			hooked.ActionRead:     hooked.PerMinute(c.Read),
+			hooked.ActionWrite:    hooked.PerMinute(c.Write),
+			hooked.ActionComment:  hooked.PerMinute(c.Comment),
+		},
+	})
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  %[1]s [flags] [serve]     run the API
+  %[1]s [flags] config      print the effective config
+  %[1]s migrate up          apply all pending migrations
+  %[1]s migrate down [N]    roll back the last N migrations (default 1)
+  %[1]s migrate status      list migrations and whether they're applied
+  %[1]s [flags] seed [seed flags]
+                           load the fixtures; see seed -h
+  %[1]s apikey create [--user ID] [--admin]
+                           create an API key and print it
+  %[1]s apikey revoke ID    revoke an API key
+
+Flags, which override env vars and the config file (see -h):
+  -config FILE             YAML or TOML config file
+  -db.host HOST, -http.port PORT, -push.backend NAME, ...
+`, os.Args[0])
+	os.Exit(2)
+}
+
+func migrate(cfg *config.Config, args []string) {
+	if len(args) == 0 {
+		usage()
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		db := connectDB(cfg.DB)
+		applied, err := migrations.Up(ctx, db)
+		if err != nil {
+			fatal("migrate", err)
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Already up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				usage()
+			}
+			steps = n
+		}
+		db := connectDB(cfg.DB)
+		rolledBack, err := migrations.Down(ctx, db, steps)
+		if err != nil {
+			fatal("migrate", err)
+		}
+		for _, m := range rolledBack {
+			fmt.Printf("Rolled back %04d_%s\n", m.Version, m.Name)
+		}
+	case "status":
+		db := connectDB(cfg.DB)
+		statuses, err := migrations.Statuses(ctx, db)
+		if err != nil {
+			fatal("migrate", err)
+		}
+		for _, st := range statuses {
+			state := "pending"
+			if st.Applied {
+				state = "applied " + st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-30s %s\n", st.Version, st.Name, state)
+		}
+	default:
+		usage()
+	}
+}
+
+func seed(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	reset := fs.Bool("reset", false,
+		"delete ALL existing data before loading the fixtures")
+	upsert := fs.Bool("upsert", false,
+		"overwrite existing users, stories and activities with the fixtures")
+	strict := fs.Bool("strict", false,
+		"load nothing at all if any fixture row is bad")
+	dir := fs.String("dir", cfg.Fixtures.Dir,
+		"directory with users, stories and activities fixture files "+
+			"(.json, .ndjson, .jsonl or .csv)")
+	users := fs.String("users", "", "users fixture file, instead of the "+
+		"one in --dir")
+	stories := fs.String("stories", "", "stories fixture file, instead of "+
+		"the one in --dir")
+	activities := fs.String("activities", "", "activities fixture file, "+
+		"instead of the one in --dir")
+	fs.Parse(args)
+	if *reset && *upsert {
+		fatal("seed",
+			errors.New("pass either --reset or --upsert, not both"))
+	}
+	var src hooked.FixtureSource
+	if *users == "" || *stories == "" || *activities == "" {
+		var err error
+		src, err = hooked.FixtureDir(*dir)
+		if err != nil {
+			fatal("fixture-dir", err)
+		}
+	}
+	for _, f := range []struct{ flag, path *string }{
+		{users, &src.Users}, {stories, &src.Stories},
+		{activities, &src.Activities}} {
+		if *f.flag != "" {
+			*f.path = *f.flag
+		}
+	}
+	db := initializeDB(cfg.DB)
+	slog.Debug("Loading fixtures", "users", src.Users, "stories",
+		src.Stories, "activities", src.Activities)
+	report, err := hooked.LoadFixtures(db, hooked.SeedOptions{
+		Source: src,
+		Reset:  *reset,
+		Upsert: *upsert,
+		Strict: *strict,
+	}, storeOptions(cfg)...)
+	if err != nil {
+		fatal("load-fixtures", err)
+	}
+	slog.Debug("Done loading fixtures")
+	report.Print(os.Stdout)
+}
+
+func apikey(cfg *config.Config, args []string) {
+	if len(args) == 0 {
+		usage()
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ExitOnError)
+		user := fs.String("user", "", "the user the key acts as")
+		admin := fs.Bool("admin", false, "whether the key may act as anyone")
+		fs.Parse(args[1:])
+		if *user == "" && !*admin {
+			fatal("create-api-key",
+				errors.New("pass --user, --admin or both"))
+		}
+		store := hooked.NewPostgresStore(initializeDB(cfg.DB))
+		key, k, err := hooked.NewAPIKey(ctx, store, *user, *admin)
+		if err != nil {
+			fatal("create-api-key", err)
+		}
+		fmt.Printf("Created key %s. It won't be shown again:\n%s\n", k.ID,
+			key)
+	case "revoke":
+		if len(args) != 2 {
+			usage()
+		}
+		store := hooked.NewPostgresStore(initializeDB(cfg.DB))
+		if err := store.RevokeAPIKey(ctx, args[1]); err != nil {
+			fatal("revoke-api-key", err)
+		}
+		fmt.Printf("Revoked key %s\n", args[1])
+	default:
+		usage()
+	}
 }
 
 func main() {
-	log.Println("Connecting to db...")
-	db := initializeDB()
-	log.Printf("[DEBUG] Ready to serve")
-	hooked.Serve(db, "8086")
+	cfg, args, err := config.Load(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal("config", err)
+	}
+	logger, err := logging.New(os.Stderr, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		fatal("logging", err)
+	}
+	// This also sends anything logged through the log package to logger.
+	slog.SetDefault(logger)
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve":
+		case "config":
+			cfg.Print(os.Stdout)
+			return
+		case "migrate":
+			migrate(cfg, args[1:])
+			return
+		case "seed":
+			seed(cfg, args[1:])
+			return
+		case "apikey":
+			apikey(cfg, args[1:])
+			return
+		default:
+			usage()
+		}
+	}
+	slog.Info("Connecting to db")
+	db := initializeDB(cfg.DB)
+	dispatcher := initializePush(db, cfg.Push)
+	srv, err := hooked.NewServer(
+		hooked.WithAddr(fmt.Sprintf(":%d", cfg.HTTP.Port)),
+		hooked.WithStore(hooked.InstrumentStore(
+			hooked.NewPostgresStore(db, storeOptions(cfg)...))),
+		hooked.WithPush(dispatcher),
+		hooked.WithLogger(logger),
+		hooked.WithTimeouts(cfg.HTTP.ReadTimeout, cfg.HTTP.WriteTimeout,
+			cfg.HTTP.IdleTimeout),
+		hooked.WithShutdownTimeout(cfg.HTTP.ShutdownTimeout),
+		hooked.WithIdempotencyTTL(cfg.HTTP.IdempotencyTTL),
+		hooked.WithPageLimits(cfg.Feed.DefaultLimit, cfg.Feed.MaxLimit),
+		hooked.WithAuth(cfg.Auth.Enabled),
+		initializeRateLimit(db, cfg.RateLimit),
+		hooked.WithBuildInfo(hooked.BuildInfo{
+			Version:   version,
+			Commit:    commit,
+			BuildDate: buildDate,
+		}),
+		hooked.WithReadyCheck("db", db.PingContext),
+		hooked.WithReadyCheck("migrations", func(ctx context.Context) error {
+			pending, err := migrations.Pending(ctx, db)
+			if err != nil {
+				return err
+			}
+			if len(pending) > 0 {
+				return fmt.Errorf("%d migrations pending", len(pending))
+			}
+			return nil
+		}),
+	)
+	if err != nil {
+		fatal("new-server", err)
+	}
+	var buf bytes.Buffer
+	cfg.Print(&buf)
+	slog.Debug("Effective config:\n" + buf.String())
+	slog.Debug("Ready to serve")
+	if err := srv.Run(); err != nil {
+		fatal("serve", err)
+	}
+	slog.Info("Shut down cleanly")
 }
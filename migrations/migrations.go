@@ -0,0 +1,275 @@
+// Package migrations keeps the database schema up to date. Migrations are
+// numbered pairs of SQL files in sql/, NNNN_name.up.sql and
+// NNNN_name.down.sql, embedded in the binary. The schema_migrations table
+// records which ones have been applied.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// lockID is the key of the Postgres advisory lock held while migrating, so
+// that several instances starting at once don't migrate at the same time.
+const lockID = 0x686f6f6b6564 // "hooked"
+
+// A Migration is one numbered schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is the state of one migration in a database.
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// All returns every migration, in order.
+func All() ([]Migration, error) {
+	entries, err := files.ReadDir("sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migrations: bad file name %s", name)
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("migrations: bad file name %s", name)
+		}
+		body, err := files.ReadFile(path.Join("sql", name))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		} else if m.Name != parts[1] {
+			return nil, fmt.Errorf("migrations: version %d is used twice",
+				version)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrations: %04d_%s needs both up and down",
+				m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// withLock runs fn on a single connection holding the migration lock.
+func withLock(ctx context.Context, db *sql.DB,
+	fn func(conn *sql.Conn) error) error {
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockID)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(),
+		"SELECT pg_advisory_unlock($1)", lockID)
+
+	_, err = conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations(
+            version integer primary key,
+            name text NOT NULL,
+            applied_at timestamptz NOT NULL DEFAULT now()
+        )`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// queryer is a *sql.DB or *sql.Conn.
+type queryer interface {
+	QueryContext(ctx context.Context, query string,
+		args ...interface{}) (*sql.Rows, error)
+}
+
+// applied returns when each applied migration was applied, by version.
+func applied(ctx context.Context, q queryer) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx,
+		"SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		versions[version] = at
+	}
+	return versions, rows.Err()
+}
+
+// run applies one migration in either direction, in a transaction.
+func run(ctx context.Context, conn *sql.Conn, m Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	body := m.Down
+	if up {
+		body = m.Up
+	}
+	_, err = tx.ExecContext(ctx, body)
+	if err == nil {
+		if up {
+			_, err = tx.ExecContext(ctx, `
+                INSERT INTO schema_migrations (version, name) VALUES ($1, $2)
+            `, m.Version, m.Name)
+		} else {
+			_, err = tx.ExecContext(ctx,
+				"DELETE FROM schema_migrations WHERE version = $1", m.Version)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migrations: %04d_%s: %v", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
+
+// Up applies every migration that hasn't been applied yet, and returns
+// the ones it applied.
+func Up(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	err = withLock(ctx, db, func(conn *sql.Conn) error {
+		versions, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range all {
+			if _, ok := versions[m.Version]; ok {
+				continue
+			}
+			if err := run(ctx, conn, m, true); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down rolls back the last steps applied migrations, and returns the ones
+// it rolled back.
+func Down(ctx context.Context, db *sql.DB, steps int) ([]Migration, error) {
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	err = withLock(ctx, db, func(conn *sql.Conn) error {
+		versions, err := applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(all) - 1; i >= 0 && len(done) < steps; i-- {
+			m := all[i]
+			if _, ok := versions[m.Version]; !ok {
+				continue
+			}
+			if err := run(ctx, conn, m, false); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Statuses returns the state of every migration.
+func Statuses(ctx context.Context, db *sql.DB) ([]Status, error) {
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+	var versions map[int]time.Time
+	err = withLock(ctx, db, func(conn *sql.Conn) error {
+		versions, err = applied(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, len(all))
+	for i, m := range all {
+		at, ok := versions[m.Version]
+		statuses[i] = Status{Migration: m, Applied: ok, AppliedAt: at}
+	}
+	return statuses, nil
+}
+
+// Pending returns the migrations that haven't been applied yet. Unlike
+// Statuses, it doesn't wait for the migration lock, so it's cheap enough
+// for health checks.
+func Pending(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := applied(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range all {
+		if _, ok := versions[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
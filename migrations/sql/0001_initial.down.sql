@@ -0,0 +1,5 @@
+DROP TABLE notifications;
+DROP TABLE followers;
+DROP TABLE activities;
+DROP TABLE stories;
+DROP TABLE users;
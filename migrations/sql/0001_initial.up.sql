@@ -0,0 +1,49 @@
+-- The original schema. IF NOT EXISTS, since databases created before we
+-- had migrations already have these tables.
+CREATE TABLE IF NOT EXISTS users(
+    sid varchar(24) primary key,
+    firstname varchar(40) NOT NULL,
+    lastname varchar(40) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS stories(
+    sid varchar(24) primary key,
+    title varchar(128) NOT NULL,
+    author_id varchar(24) REFERENCES users(sid)
+);
+
+CREATE TABLE IF NOT EXISTS activities(
+    sid varchar(24) primary key,
+    action varchar(24) NOT NULL,
+    date timestamptz NOT NULL,
+    actor_id varchar(24) REFERENCES users(sid),
+    story_id varchar(24) REFERENCES stories(sid),
+    user2_id varchar(24) REFERENCES users(sid)
+);
+
+CREATE TABLE IF NOT EXISTS followers(
+    user_id varchar(24) REFERENCES users(sid),
+    follower_id varchar(24) REFERENCES users(sid),
+    primary key (user_id, follower_id)
+);
+
+-- Technically notifications can be computed from the activities,
+-- but that is inefficient. Let's instead create a notifications
+-- table.
+-- In this case, the `notified` is the user whose notification we are getting.
+-- The `actor` is the performer of the action, which is not necessarily
+-- the same as the notified user.
+-- In the case of a follow, it will be mapped to `user2` in the API output.
+-- Story is null if this is a follow.
+CREATE TABLE IF NOT EXISTS notifications(
+    id uuid primary key,
+    notified_id varchar(24) REFERENCES users(sid),
+    actor_id varchar(24) REFERENCES users(sid),
+    action varchar(24) NOT NULL,
+    date timestamptz NOT NULL,
+    story_id varchar(24) REFERENCES stories(sid)
+);
+
+-- Note: It seems worthwhile to create tables for loves,
+-- comments, likes, etc in the future. For now let's use the activities
+-- table as the source of truth.
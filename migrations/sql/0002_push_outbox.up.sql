@@ -0,0 +1,16 @@
+-- Push notifications waiting to be delivered. Rows are written in the
+-- same transaction as the activity that caused them, and drained by
+-- the push dispatcher.
+CREATE TABLE IF NOT EXISTS push_outbox(
+    id uuid primary key,
+    user_id varchar(24) REFERENCES users(sid),
+    body text NOT NULL,
+    status varchar(12) NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text,
+    created_at timestamptz NOT NULL,
+    next_attempt_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS push_outbox_due
+ON push_outbox (status, next_attempt_at);
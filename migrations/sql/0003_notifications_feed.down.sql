@@ -0,0 +1 @@
+DROP INDEX notifications_feed;
@@ -0,0 +1,3 @@
+-- The notifications feed is read newest first, a page at a time.
+CREATE INDEX IF NOT EXISTS notifications_feed
+ON notifications (notified_id, date DESC);
@@ -0,0 +1,4 @@
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS read_at timestamptz;
+
+CREATE INDEX IF NOT EXISTS notifications_unread
+ON notifications (notified_id) WHERE read_at IS NULL;
@@ -0,0 +1,5 @@
+DROP TABLE notification_reads;
+DROP INDEX followers_follower;
+DROP INDEX activities_fanout_on_read;
+ALTER TABLE activities DROP COLUMN fanout_on_read;
+ALTER TABLE followers DROP COLUMN since;
@@ -0,0 +1,22 @@
+-- Accounts with many followers fan out on read: their activities are
+-- flagged rather than copied to every follower, and merged into each
+-- follower's feed for the activities since they followed.
+ALTER TABLE followers
+ADD COLUMN IF NOT EXISTS since timestamptz NOT NULL DEFAULT now();
+
+ALTER TABLE activities
+ADD COLUMN IF NOT EXISTS fanout_on_read boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS activities_fanout_on_read
+ON activities (actor_id, date) WHERE fanout_on_read;
+
+CREATE INDEX IF NOT EXISTS followers_follower
+ON followers (follower_id);
+
+-- The read state of those merged notifications.
+CREATE TABLE IF NOT EXISTS notification_reads(
+    notified_id varchar(24) REFERENCES users(sid),
+    activity_id varchar(24) REFERENCES activities(sid),
+    read_at timestamptz NOT NULL,
+    primary key (notified_id, activity_id)
+);
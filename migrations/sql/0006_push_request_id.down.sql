@@ -0,0 +1 @@
+ALTER TABLE push_outbox DROP COLUMN request_id;
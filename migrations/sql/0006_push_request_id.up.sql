@@ -0,0 +1,3 @@
+-- The ID of the API request that queued each push notification, so that
+-- delivery logs can be tied back to it.
+ALTER TABLE push_outbox ADD COLUMN IF NOT EXISTS request_id text;
@@ -0,0 +1,12 @@
+-- API keys. Only a SHA-256 hash of each key is kept. A key belongs to a
+-- user, and can only act as that user, unless it's an admin key, which
+-- can do anything and needn't belong to anyone.
+CREATE TABLE IF NOT EXISTS api_keys(
+    id uuid primary key,
+    key_hash char(64) NOT NULL UNIQUE,
+    user_id varchar(24) REFERENCES users(sid),
+    admin boolean NOT NULL DEFAULT false,
+    created_at timestamptz NOT NULL,
+    revoked_at timestamptz,
+    CHECK (admin OR user_id IS NOT NULL)
+);
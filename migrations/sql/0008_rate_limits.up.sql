@@ -0,0 +1,11 @@
+-- Token buckets for rate limiting, shared by every API instance. A bucket
+-- is full again after full_at, which is the same as having no row, so
+-- those rows are deleted.
+CREATE TABLE IF NOT EXISTS rate_limits(
+    key text primary key,
+    tokens double precision NOT NULL,
+    updated_at timestamptz NOT NULL,
+    full_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_full_at ON rate_limits (full_at);
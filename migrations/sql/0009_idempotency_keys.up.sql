@@ -0,0 +1,16 @@
+-- Requests made with an Idempotency-Key header, and the responses they
+-- got, so that retries get the same response instead of being done again.
+-- owner is the ID of the API key the request was made with; keys are only
+-- unique per API key.
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+    owner text NOT NULL,
+    key text NOT NULL,
+    fingerprint char(64) NOT NULL,
+    status integer NOT NULL,
+    body bytea NOT NULL,
+    expires_at timestamptz NOT NULL,
+    primary key (owner, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at
+ON idempotency_keys (expires_at);
@@ -0,0 +1,5 @@
+DROP INDEX push_outbox_activity;
+ALTER TABLE push_outbox DROP COLUMN activity_id;
+DROP INDEX notifications_activity;
+ALTER TABLE notifications DROP COLUMN activity_id;
+ALTER TABLE activities DROP COLUMN deleted_at;
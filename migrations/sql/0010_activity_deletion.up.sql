@@ -0,0 +1,36 @@
+-- Activities can be deleted, by unloving or through the API. They're kept,
+-- marked deleted, but the notifications they made are deleted, so each
+-- notification needs to know which activity made it.
+ALTER TABLE activities ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+
+ALTER TABLE notifications
+ADD COLUMN IF NOT EXISTS activity_id varchar(24) REFERENCES activities(sid);
+
+CREATE INDEX IF NOT EXISTS notifications_activity
+ON notifications (activity_id);
+
+-- Push notifications that haven't gone out yet are cancelled too.
+ALTER TABLE push_outbox
+ADD COLUMN IF NOT EXISTS activity_id varchar(24) REFERENCES activities(sid);
+
+CREATE INDEX IF NOT EXISTS push_outbox_activity
+ON push_outbox (activity_id) WHERE status = 'pending';
+
+-- Link up the notifications made so far with the activities that made
+-- them: the ones with the same actor, action and story (write and follow
+-- notifications have no story), and for follows, the same followed user.
+-- The API dated notifications separately from their activities, so the
+-- dates can be a little apart; take the closest activity within a minute.
+-- Notifications that still don't match stay unlinked, and aren't deleted
+-- along with their activity.
+UPDATE notifications n SET activity_id = (
+    SELECT a.sid FROM activities a
+    WHERE a.actor_id = n.actor_id AND a.action = n.action
+        AND (n.story_id IS NULL OR n.story_id = a.story_id)
+        AND (n.action <> 'follow' OR a.user2_id = n.notified_id)
+        AND a.date BETWEEN n.date - interval '1 minute'
+            AND n.date + interval '1 minute'
+    ORDER BY abs(extract(epoch FROM n.date - a.date)), a.sid
+    LIMIT 1
+)
+WHERE n.activity_id IS NULL;
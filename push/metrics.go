@@ -0,0 +1,54 @@
+package push
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	deliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_deliveries_total",
+		Help: "Push notification delivery attempts, by backend and result.",
+	}, []string{"backend", "result"})
+	deliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "push_delivery_duration_seconds",
+		Help:    "How long push notification delivery attempts take.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+	deadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "push_dead_letters_total",
+		Help: "Push notifications given up on after too many attempts.",
+	})
+)
+
+// meteredSender counts and times the deliveries of the Sender it wraps.
+// New wraps every backend in one.
+type meteredSender struct {
+	backend string
+	Sender
+}
+
+func (s meteredSender) Send(userid string, notification string) error {
+	start := time.Now()
+	err := s.Sender.Send(userid, notification)
+	deliveryDuration.WithLabelValues(s.backend).Observe(
+		time.Since(start).Seconds())
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	deliveries.WithLabelValues(s.backend, result).Inc()
+	return err
+}
+
+// Check passes the check on to the wrapped Sender, if it can check its
+// backend at all.
+func (s meteredSender) Check(ctx context.Context) error {
+	if c, ok := s.Sender.(Checker); ok {
+		return c.Check(ctx)
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
-// Package push implements our push notifications. For now, this will
-// just be a mock.
+// Package push implements our push notifications. Notifications are
+// written to a Postgres outbox (see Enqueue) and delivered by a Dispatcher
+// through a Sender; which one is decided by configuration (see New). The
+// stdout backend is still just a mock.
 package push
 
 import (
@@ -7,6 +9,20 @@ import (
 	"strings"
 )
 
+func init() {
+	Register("stdout", func(cfg Config) (Sender, error) {
+		return stdoutSender{}, nil
+	})
+}
+
+// stdoutSender prints notifications instead of delivering them.
+type stdoutSender struct{}
+
+func (stdoutSender) Send(userid string, notification string) error {
+	notify(userid, notification)
+	return nil
+}
+
 func notify(userid string, notification string) {
 	delimiter := strings.Repeat("-", 30) + "\n"
 	templateStr := delimiter + fmt.Sprintf(
@@ -16,20 +32,3 @@ func notify(userid string, notification string) {
 
 	fmt.Println(templateStr)
 }
-
-func Notify(userid string, notification string) {
-	// This goroutine, and the fact that the API in general uses goroutines
-	// for HTTP requests, allows the API to scale more easily. We don't block
-	// until all push notifications are delivered, instead we hand them off
-	// in a goroutine and exit. This could be a separate microservice
-	// or job queue later on.
-	go func() {
-		notify(userid, notification)
-	}()
-}
-
-func NotifyMultiple(userids []string, notification string) {
-	for _, userid := range userids {
-		Notify(userid, notification)
-	}
-}
@@ -0,0 +1,214 @@
+package push
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/domino14/cool-api/logging"
+	"github.com/satori/go.uuid"
+)
+
+// Outbox states. A delivery starts out pending, and ends up either sent or,
+// after too many failed attempts, dead.
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+	StatusDead    = "dead"
+)
+
+// ErrNotDead is returned when replaying a delivery that isn't dead-lettered.
+var ErrNotDead = errors.New("No dead delivery with that ID.")
+
+// A Message is a notification addressed to one user.
+type Message struct {
+	UserID string
+	Body   string
+	// ActivityID is the activity the message is about, if any, so that
+	// deleting the activity can cancel it.
+	ActivityID string
+}
+
+// A Delivery is a Message as it sits in the outbox.
+type Delivery struct {
+	ID            string    `json:"id"`
+	RequestID     string    `json:"request_id,omitempty"`
+	UserID        string    `json:"user_id"`
+	Body          string    `json:"body"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// Execer is satisfied by both *sql.DB and *sql.Tx.
+type Execer interface {
+	ExecContext(ctx context.Context, query string,
+		args ...interface{}) (sql.Result, error)
+}
+
+// Enqueue adds messages to the outbox. Pass the *sql.Tx that the
+// triggering change is being written in, so that the notifications are
+// stored if and only if that change commits. The request ID in ctx, if
+// any, is stored with them for the delivery logs.
+func Enqueue(ctx context.Context, e Execer, msgs ...Message) error {
+	requestID := sql.NullString{String: logging.RequestID(ctx)}
+	requestID.Valid = requestID.String != ""
+	for _, m := range msgs {
+		activityID := sql.NullString{String: m.ActivityID}
+		activityID.Valid = activityID.String != ""
+		_, err := e.ExecContext(ctx, `
+            INSERT INTO push_outbox
+            (id, request_id, user_id, body, status, attempts, created_at,
+                next_attempt_at, activity_id)
+            VALUES ($1, $2, $3, $4, $5, 0, now(), now(), $6)
+        `, uuid.NewV4(), requestID, m.UserID, m.Body, StatusPending,
+			activityID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel deletes the activity's messages that haven't been delivered yet,
+// including the ones waiting to be retried, and returns how many there
+// were. Like Enqueue, it takes the transaction deleting the activity. A
+// message that a worker is sending right now still goes out.
+func Cancel(ctx context.Context, e Execer, activityID string) (int, error) {
+	res, err := e.ExecContext(ctx, `
+        DELETE FROM push_outbox WHERE activity_id = $1 AND status = $2
+    `, activityID, StatusPending)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Outbox is the Postgres-backed queue of pending push deliveries.
+type Outbox struct {
+	db *sql.DB
+}
+
+func NewOutbox(db *sql.DB) *Outbox {
+	return &Outbox{db: db}
+}
+
+// claim leases up to limit due deliveries. Claimed rows are pushed back by
+// lease, so that if this process dies mid-send another worker retries them
+// once the lease runs out.
+func (o *Outbox) claim(limit int, lease time.Duration) ([]Delivery, error) {
+	rows, err := o.db.Query(`
+        UPDATE push_outbox
+        SET next_attempt_at = now() + $2 * interval '1 millisecond'
+        WHERE id IN (
+            SELECT id FROM push_outbox
+            WHERE status = $3 AND next_attempt_at <= now()
+            ORDER BY next_attempt_at
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, request_id, user_id, body, attempts
+    `, limit, lease.Nanoseconds()/int64(time.Millisecond), StatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		var requestID sql.NullString
+		err = rows.Scan(&d.ID, &requestID, &d.UserID, &d.Body, &d.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		d.RequestID = requestID.String
+		d.Status = StatusPending
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (o *Outbox) markSent(id string) error {
+	_, err := o.db.Exec(`
+        UPDATE push_outbox
+        SET status = $2, attempts = attempts + 1, last_error = NULL
+        WHERE id = $1
+    `, id, StatusSent)
+	return err
+}
+
+// markFailed records a failed attempt. The delivery is retried at next,
+// unless dead is set.
+func (o *Outbox) markFailed(id string, sendErr error, next time.Time,
+	dead bool) error {
+
+	status := StatusPending
+	if dead {
+		status = StatusDead
+	}
+	_, err := o.db.Exec(`
+        UPDATE push_outbox
+        SET status = $2, attempts = attempts + 1, last_error = $3,
+            next_attempt_at = $4
+        WHERE id = $1
+    `, id, status, sendErr.Error(), next)
+	return err
+}
+
+// DeadLetters returns up to limit dead deliveries, newest first.
+func (o *Outbox) DeadLetters(limit int) ([]Delivery, error) {
+	rows, err := o.db.Query(`
+        SELECT id, request_id, user_id, body, status, attempts, last_error,
+            created_at, next_attempt_at
+        FROM push_outbox
+        WHERE status = $1
+        ORDER BY created_at DESC
+        LIMIT $2
+    `, StatusDead, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		var requestID, lastError sql.NullString
+		err = rows.Scan(&d.ID, &requestID, &d.UserID, &d.Body, &d.Status,
+			&d.Attempts, &lastError, &d.CreatedAt, &d.NextAttemptAt)
+		if err != nil {
+			return nil, err
+		}
+		d.RequestID = requestID.String
+		d.LastError = lastError.String
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Replay puts a dead delivery back in the queue with a fresh set of
+// attempts.
+func (o *Outbox) Replay(id string) error {
+	if _, err := uuid.FromString(id); err != nil {
+		return ErrNotDead
+	}
+	res, err := o.db.Exec(`
+        UPDATE push_outbox
+        SET status = $2, attempts = 0, next_attempt_at = now()
+        WHERE id = $1 AND status = $3
+    `, id, StatusPending, StatusDead)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotDead
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	Register("provider", newProviderSender)
+}
+
+// providerSender talks to an APNs/FCM-style JSON-over-HTTP push provider.
+// Messages are addressed to the user ID for now, since we don't store
+// device tokens yet. Point the endpoint at a local stub server in
+// development.
+type providerSender struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+type providerMessage struct {
+	Message struct {
+		Token        string `json:"token"`
+		Notification struct {
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		} `json:"notification"`
+	} `json:"message"`
+}
+
+// providerResponse is what the provider replies with. A 2xx response can
+// still carry an error, e.g. for an unregistered token.
+type providerResponse struct {
+	Name  string `json:"name"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newProviderSender(cfg Config) (Sender, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("push: provider backend needs an endpoint")
+	}
+	return &providerSender{
+		client:   &http.Client{Timeout: cfg.Timeout},
+		endpoint: strings.TrimRight(cfg.Endpoint, "/") + "/v1/messages:send",
+		token:    cfg.AuthToken,
+	}, nil
+}
+
+func (s *providerSender) Send(userid string, notification string) error {
+	var msg providerMessage
+	msg.Message.Token = userid
+	msg.Message.Notification.Title = "Hooked"
+	msg.Message.Notification.Body = notification
+
+	resp, err := postJSON(s.client, s.endpoint, s.token, msg)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A 2xx without a body is a delivery with nothing more to say.
+	var pr providerResponse
+	err = json.NewDecoder(resp.Body).Decode(&pr)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("push: bad provider response: %v", err)
+	}
+	if pr.Error != nil {
+		return fmt.Errorf("push: provider error %d %s: %s", pr.Error.Code,
+			pr.Error.Status, pr.Error.Message)
+	}
+	return nil
+}
+
+func (s *providerSender) Check(ctx context.Context) error {
+	return checkReachable(ctx, s.client, s.endpoint)
+}
@@ -0,0 +1,43 @@
+package push
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProviderSend(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		ok     bool
+	}{
+		{"sent", http.StatusOK, `{"name":"messages/1"}`, true},
+		{"no body", http.StatusOK, "", true},
+		{"no content", http.StatusNoContent, "", true},
+		{"error in body", http.StatusOK,
+			`{"error":{"code":404,"status":"NOT_FOUND","message":"gone"}}`,
+			false},
+		{"bad body", http.StatusOK, "not json", false},
+		{"server error", http.StatusInternalServerError, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tc.status)
+					io.WriteString(w, tc.body)
+				}))
+			defer srv.Close()
+			s, err := newProviderSender(Config{Endpoint: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Send("u1", "hello")
+			if (err == nil) != tc.ok {
+				t.Errorf("Send returned %v, want ok = %v", err, tc.ok)
+			}
+		})
+	}
+}
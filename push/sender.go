@@ -0,0 +1,90 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Sender delivers a single push notification to a user. Implementations
+// should be safe for concurrent use.
+type Sender interface {
+	Send(userid string, notification string) error
+}
+
+// A Checker is a Sender that can tell whether its backend is reachable,
+// for readiness checks.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Config holds the settings a backend may need. Not every backend uses
+// every field; the stdout backend ignores all of them.
+type Config struct {
+	// Endpoint is the URL that notifications are POSTed to.
+	Endpoint string
+	// AuthToken is sent as a bearer token, if set.
+	AuthToken string
+	// Timeout bounds each delivery request.
+	Timeout time.Duration
+}
+
+// DefaultTimeout is used when a Config doesn't specify one.
+const DefaultTimeout = 5 * time.Second
+
+// A Factory builds a Sender from a Config.
+type Factory func(cfg Config) (Sender, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a backend available under the given name. It panics if
+// the name is registered twice, like database/sql does for drivers.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("push: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("push: Register called twice for backend " + name)
+	}
+	registry[name] = factory
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a Sender for the named backend. Its deliveries are counted
+// in the push_* metrics.
+func New(name string, cfg Config) (Sender, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("push: unknown backend %q (have %s)", name,
+			strings.Join(Backends(), ", "))
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	s, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return meteredSender{name, s}, nil
+}
@@ -0,0 +1,103 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+func init() {
+	Register("webhook", newWebhookSender)
+}
+
+// webhookSender POSTs every notification as a small JSON document to a
+// single URL. Whatever listens there is responsible for delivery.
+type webhookSender struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+type webhookPayload struct {
+	UserID       string `json:"user_id"`
+	Notification string `json:"notification"`
+}
+
+func newWebhookSender(cfg Config) (Sender, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("push: webhook backend needs an endpoint")
+	}
+	return &webhookSender{
+		client:   &http.Client{Timeout: cfg.Timeout},
+		endpoint: cfg.Endpoint,
+		token:    cfg.AuthToken,
+	}, nil
+}
+
+func (s *webhookSender) Send(userid string, notification string) error {
+	resp, err := postJSON(s.client, s.endpoint, s.token, webhookPayload{
+		UserID:       userid,
+		Notification: notification,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *webhookSender) Check(ctx context.Context) error {
+	return checkReachable(ctx, s.client, s.endpoint)
+}
+
+// checkReachable makes a HEAD request to url. Any HTTP response at all
+// means the server is up; only failing to get one is an error.
+func checkReachable(ctx context.Context, client *http.Client,
+	url string) error {
+
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// postJSON POSTs v as JSON and returns an error for any non-2xx response.
+// The caller must close the body of a successful response.
+func postJSON(client *http.Client, url, token string, v interface{}) (
+	*http.Response, error) {
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("push: %s returned %s: %s", url, resp.Status,
+			bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
@@ -0,0 +1,164 @@
+package push
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Dispatcher drains the outbox with a pool of workers, delivering each
+// message through a Sender. Failed deliveries are retried with exponential
+// backoff, and dead-lettered after MaxAttempts.
+type Dispatcher struct {
+	Outbox *Outbox
+	Sender Sender
+
+	Workers      int
+	BatchSize    int
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	PollInterval time.Duration
+	// Lease is how long a claimed delivery stays invisible to other
+	// workers. It should be well above the sender's timeout.
+	Lease time.Duration
+	// Logger is where failed deliveries are logged.
+	Logger *slog.Logger
+
+	stop      chan struct{}
+	drain     chan struct{}
+	stopOnce  sync.Once
+	drainOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewDispatcher returns a Dispatcher with sensible defaults. Adjust the
+// fields before calling Start. Always make Dispatchers with NewDispatcher,
+// so that Stop and Shutdown work even before Start.
+func NewDispatcher(o *Outbox, s Sender) *Dispatcher {
+	return &Dispatcher{
+		Outbox:       o,
+		Sender:       s,
+		Workers:      4,
+		BatchSize:    10,
+		MaxAttempts:  8,
+		BaseDelay:    2 * time.Second,
+		MaxDelay:     30 * time.Minute,
+		PollInterval: time.Second,
+		Lease:        time.Minute,
+		Logger:       slog.Default(),
+		stop:         make(chan struct{}),
+		drain:        make(chan struct{}),
+	}
+}
+
+// Start launches the workers. A Dispatcher can't be started again once
+// it's stopped.
+func (d *Dispatcher) Start() {
+	for i := 0; i < d.Workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+}
+
+// Stop tells the workers to quit, and waits for the deliveries they're
+// working on to finish.
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
+	d.wg.Wait()
+}
+
+// Shutdown delivers everything that is currently due and then stops the
+// workers. If ctx expires first, it stops them right away, like Stop.
+// Retries scheduled for later stay in the outbox for the next start.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.drainOnce.Do(func() { close(d.drain) })
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		d.Stop()
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		deliveries, err := d.Outbox.claim(d.BatchSize, d.Lease)
+		if err != nil {
+			d.Logger.Error("push-claim", "err", err)
+		}
+		for _, delivery := range deliveries {
+			select {
+			case <-d.stop:
+				// The rest of the batch is retried when its lease is up.
+				return
+			default:
+			}
+			d.deliver(delivery)
+		}
+		if len(deliveries) == 0 {
+			select {
+			case <-d.stop:
+				return
+			case <-d.drain:
+				// Draining and nothing is due; we're done.
+				return
+			case <-time.After(d.PollInterval):
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(delivery Delivery) {
+	logger := d.Logger.With("delivery_id", delivery.ID)
+	if delivery.RequestID != "" {
+		logger = logger.With("request_id", delivery.RequestID)
+	}
+	sendErr := d.Sender.Send(delivery.UserID, delivery.Body)
+	var err error
+	if sendErr == nil {
+		logger.Debug("Delivered push notification", "user", delivery.UserID)
+		err = d.Outbox.markSent(delivery.ID)
+	} else {
+		attempts := delivery.Attempts + 1
+		dead := attempts >= d.MaxAttempts
+		if dead {
+			deadLetters.Inc()
+			logger.Error("push-dead-letter", "attempts", attempts,
+				"err", sendErr)
+		} else {
+			logger.Info("push-retry", "attempts", attempts, "err", sendErr)
+		}
+		err = d.Outbox.markFailed(delivery.ID, sendErr,
+			time.Now().Add(d.backoff(attempts)), dead)
+	}
+	if err != nil {
+		logger.Error("push-mark", "err", err)
+	}
+}
+
+// backoff returns how long to wait after the given number of attempts:
+// BaseDelay, doubling every time, up to MaxDelay.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= d.MaxDelay {
+			return d.MaxDelay
+		}
+	}
+	return delay
+}